@@ -0,0 +1,322 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Admin console actions.
+const (
+	AdminOpenPolls         = "open_polls"
+	AdminClosePolls        = "close_polls"
+	AdminAddCandidate      = "add_candidate"
+	AdminWithdrawCandidate = "withdraw_candidate"
+	AdminEditBio           = "edit_bio"
+	AdminEditPosition      = "edit_position"
+)
+
+// AdminChange is a change made from the admin console. Changes are stored in
+// the database and applied in order on top of config.yml whenever the server
+// starts.
+type AdminChange struct {
+	ID        uint `gorm:"primary_key"`
+	Action    string
+	Position  string
+	Candidate string
+	// Value is the new description for edit_bio and edit_position.
+	Value string
+	// Image is the new image for edit_bio.
+	Image     string
+	User      string
+	CreatedAt time.Time
+}
+
+// locked reports whether the action changes the ballot and so can't be made
+// after voting has started. Polls can always be opened and closed, and
+// candidates can always withdraw.
+func (a AdminChange) locked() bool {
+	switch a.Action {
+	case AdminOpenPolls, AdminClosePolls, AdminWithdrawCandidate:
+		return false
+	}
+	return true
+}
+
+// auditDetails returns the details recorded in the audit log for the change.
+func (a AdminChange) auditDetails() map[string]string {
+	details := map[string]string{"user": a.User, "action": a.Action}
+	for k, v := range map[string]string{
+		"position":  a.Position,
+		"candidate": a.Candidate,
+		"value":     a.Value,
+		"image":     a.Image,
+	} {
+		if v != "" {
+			details[k] = v
+		}
+	}
+	return details
+}
+
+func (c Config) findPosition(name string) (int, error) {
+	for i, p := range c.Positions {
+		if p.Name == name {
+			return i, nil
+		}
+	}
+	return 0, errors.Errorf("unknown position %q", name)
+}
+
+func (c Config) running(candidate string) bool {
+	for _, p := range c.Positions {
+		for _, name := range p.Running() {
+			if name == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyAdminChange applies a change to the config. It copies anything it
+// modifies so that the original config is unchanged if it fails.
+func (c *Config) applyAdminChange(change AdminChange) error {
+	switch change.Action {
+	case AdminOpenPolls:
+		c.PollOverride = PollOpen
+	case AdminClosePolls:
+		c.PollOverride = PollClosed
+
+	case AdminAddCandidate, AdminWithdrawCandidate, AdminEditPosition:
+		i, err := c.findPosition(change.Position)
+		if err != nil {
+			return err
+		}
+		p := c.Positions[i]
+		switch change.Action {
+		case AdminAddCandidate:
+			candidate := strings.TrimSpace(change.Candidate)
+			if candidate == "" {
+				return errors.New("candidate name is required")
+			}
+			for _, name := range p.Candidates {
+				if name == candidate {
+					return errors.Errorf("%q is already running for %q", candidate, p.Name)
+				}
+			}
+			p.Candidates = append(append([]string(nil), p.Candidates...), candidate)
+		case AdminWithdrawCandidate:
+			found := false
+			for _, name := range p.Running() {
+				found = found || name == change.Candidate
+			}
+			if !found {
+				return errors.Errorf("%q isn't running for %q", change.Candidate, p.Name)
+			}
+			p.Withdrawn = append(append([]string(nil), p.Withdrawn...), change.Candidate)
+		case AdminEditPosition:
+			p.Desc = change.Value
+		}
+		c.Positions = append([]Position(nil), c.Positions...)
+		c.Positions[i] = p
+
+	case AdminEditBio:
+		if !c.running(change.Candidate) {
+			return errors.Errorf("%q isn't running for any position", change.Candidate)
+		}
+		bios := append([]Biography(nil), c.Bios...)
+		found := false
+		for i, b := range bios {
+			if b.Name == change.Candidate {
+				bios[i].Desc = change.Value
+				bios[i].Image = change.Image
+				found = true
+			}
+		}
+		if !found {
+			bios = append(bios, Biography{Name: change.Candidate, Desc: change.Value, Image: change.Image})
+		}
+		c.Bios = bios
+
+	default:
+		return errors.Errorf("unknown action %q", change.Action)
+	}
+	return nil
+}
+
+// linkBios sets the positions each candidate with a biography is running for.
+func linkBios() {
+	positions := map[string][]string{}
+	for _, p := range c.Positions {
+		for _, c := range p.Running() {
+			positions[c] = append(positions[c], p.Name)
+		}
+	}
+	for i, b := range c.Bios {
+		c.Bios[i].Positions = positions[b.Name]
+	}
+}
+
+// loadAdminChanges applies the changes made from the admin console to c.
+func loadAdminChanges(db *gorm.DB) error {
+	if !db.HasTable(&AdminChange{}) {
+		// Not migrated yet, so there can't be any changes.
+		return nil
+	}
+	var changes []AdminChange
+	if err := db.Order("id").Find(&changes).Error; err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if err := c.applyAdminChange(change); err != nil {
+			return errors.Wrapf(err, "admin change %d", change.ID)
+		}
+	}
+	linkBios()
+	return nil
+}
+
+// ballotsCast reports whether any ballots have been cast.
+func ballotsCast(db *gorm.DB) (bool, error) {
+	count := 0
+	if err := db.Model(&BallotRecord{}).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// makeAdminChange validates, stores and applies a change from the admin
+// console. The change is applied to a copy of the config first, and is
+// rejected if the result isn't valid.
+func (s *server) makeAdminChange(change AdminChange) error {
+	tx := s.db.Begin()
+	defer tx.Rollback()
+
+	if change.locked() {
+		cast, err := ballotsCast(tx)
+		if err != nil {
+			return err
+		}
+		if cast {
+			return errors.New("Candidates and descriptions can't be changed after the first ballot has been cast.")
+		}
+	}
+
+	if change.Action == AdminOpenPolls {
+		// The ballots may have been published and committed to.
+		ended, err := votingEnded(tx)
+		if err != nil {
+			return err
+		}
+		if ended {
+			return errors.New("Polls can't be reopened once voting has ended.")
+		}
+	}
+
+	next := c
+	if err := next.applyAdminChange(change); err != nil {
+		return err
+	}
+	if err := next.validate(); err != nil {
+		return err
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	// Only copy what the console changes, since requests that don't read
+	// it, e.g. for the public key, don't hold the lock.
+	c.Positions = next.Positions
+	c.Bios = next.Bios
+	c.PollOverride = next.PollOverride
+	linkBios()
+	audit(AuditAdminChange, change.auditDetails())
+	return nil
+}
+
+// adminUser returns the logged in user if they are an admin.
+func adminUser(r *http.Request) (string, error) {
+	user := remoteUser(r)
+	if len(user) == 0 {
+		return "", errors.New("missing REMOTE_USER")
+	}
+	if !isAdmin(user) {
+		return "", errors.New("must be an admin")
+	}
+	return user, nil
+}
+
+func (s *server) handleConsole(w *TemplateWriter, r *http.Request) error {
+	w.Title("Admin Console")
+
+	user, err := adminUser(r)
+	if err != nil {
+		return err
+	}
+
+	var message string
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		if err := checkCSRF(r); err != nil {
+			return err
+		}
+		change := AdminChange{
+			Action:    r.FormValue("action"),
+			Position:  r.FormValue("position"),
+			Candidate: r.FormValue("candidate"),
+			Value:     r.FormValue("value"),
+			Image:     strings.TrimSpace(r.FormValue("image")),
+			User:      user,
+		}
+		if err := s.makeAdminChange(change); err != nil {
+			return err
+		}
+		message = "Saved."
+	}
+
+	locked, err := ballotsCast(s.db)
+	if err != nil {
+		return err
+	}
+	schedule, err := c.Schedule()
+	if err != nil {
+		return err
+	}
+	var changes []AdminChange
+	if err := s.db.Order("id desc").Find(&changes).Error; err != nil {
+		return err
+	}
+	csrf, err := csrfSession(w, r)
+	if err != nil {
+		return err
+	}
+
+	return s.tmpl.ExecuteTemplate(w, "console.html", struct {
+		Config
+		CSRF     string
+		Message  string
+		Poll     string
+		Ended    bool
+		Schedule Schedule
+		Locked   bool
+		Changes  []AdminChange
+	}{
+		Config:   c,
+		CSRF:     csrf,
+		Message:  message,
+		Poll:     c.PollState(now()),
+		Ended:    c.pollsEnded(now()),
+		Schedule: schedule,
+		Locked:   locked,
+		Changes:  changes,
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminConsole(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	post := func(values url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/console", nil)
+		req.Form = values
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := post(url.Values{"action": {AdminClosePolls}}); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "must be an admin") {
+		t.Fatalf("expected non-admin to be rejected; got %s", resp.Body.Bytes())
+	}
+	c.Admins = []string{"test"}
+
+	// Changes must come from the console.
+	req := httptest.NewRequest("POST", "/admin/console", nil)
+	req.Form = url.Values{"action": {AdminClosePolls}}
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "submitted from another site") {
+		t.Fatalf("expected change without a CSRF token to be rejected; got %s", resp.Body.Bytes())
+	}
+	if c.PollState(now()) != PollOpen {
+		t.Fatalf("expected polls to stay open")
+	}
+
+	for _, values := range []url.Values{
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"Candidate 9"}},
+		{"action": {AdminWithdrawCandidate}, "position": {"Position 2"}, "candidate": {"Candidate 3"}},
+		{"action": {AdminEditPosition}, "position": {"Position 1"}, "value": {"New description"}},
+		{"action": {AdminEditBio}, "candidate": {"Candidate 9"}, "value": {"Bio"}, "image": {"9.png"}},
+	} {
+		if resp := post(values); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Saved.") {
+			t.Fatalf("%v: expected StatusOK; got %s", values, resp.Body.Bytes())
+		}
+	}
+	for _, values := range []url.Values{
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"Candidate 9"}},
+		{"action": {AdminWithdrawCandidate}, "position": {"Position 2"}, "candidate": {"Candidate 3"}},
+		{"action": {AdminEditPosition}, "position": {"Position 99"}, "value": {"Desc"}},
+		{"action": {AdminEditBio}, "candidate": {"Nobody"}, "value": {"Bio"}},
+		{"action": {"delete_everything"}},
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"reopen nominations"}},
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"Abstain"}},
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"candidate-9"}},
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"Reopen"}},
+		{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"???"}},
+	} {
+		if resp := post(values); resp.Code != http.StatusInternalServerError {
+			t.Fatalf("%v: expected error; got %s", values, resp.Body.Bytes())
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		if got := c.Positions[5].Candidates; !reflect.DeepEqual(got, []string{"Candidate 9"}) {
+			t.Errorf("Position 6 candidates = %v", got)
+		}
+		if got := c.Positions[1].Running(); len(got) != 0 {
+			t.Errorf("Position 2 running = %v", got)
+		}
+		if got := c.Positions[0].Desc; got != "New description" {
+			t.Errorf("Position 1 desc = %q", got)
+		}
+		want := []Biography{
+			{Name: "Candidate 1", Image: "foo.png", Desc: "Test", Positions: []string{"Position 1", "Position 7"}},
+			{Name: "Candidate 9", Image: "9.png", Desc: "Bio", Positions: []string{"Position 6"}},
+		}
+		if !reflect.DeepEqual(c.Bios, want) {
+			t.Errorf("bios = %+v; wanted %+v", c.Bios, want)
+		}
+	}
+	check()
+
+	// The changes are loaded from the database when the config is reloaded.
+	s.Close()
+	c.Positions[0].Desc = "Desc"
+	c.Positions[1].Withdrawn = nil
+	c.Positions[5].Candidates = nil
+	c.Bios = c.Bios[:1]
+	s, err := setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check()
+
+	// Candidates are locked once voting has started, but they can still
+	// withdraw and polls can still be closed.
+	req = httptest.NewRequest("POST", "/vote", nil)
+	req.Form = goodForm()
+	req.Form.Del("Position 2")
+	req.Form.Set("Position 6", "Candidate 9")
+	addCSRF(t, req)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if resp := post(url.Values{"action": {AdminAddCandidate}, "position": {"Position 6"}, "candidate": {"Late"}}); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "after the first ballot") {
+		t.Fatalf("expected changes to be locked; got %s", resp.Body.Bytes())
+	}
+	if resp := post(url.Values{"action": {AdminWithdrawCandidate}, "position": {"Position 1"}, "candidate": {"Candidate 1"}}); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if resp := post(url.Values{"action": {AdminClosePolls}}); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if pollsOpen() {
+		t.Errorf("expected polls to be closed")
+	}
+	if resp := post(url.Values{"action": {AdminOpenPolls}}); resp.Code != http.StatusInternalServerError || !strings.Contains(html.UnescapeString(resp.Body.String()), "can't be reopened") {
+		t.Fatalf("expected closed polls not to reopen; got %s", resp.Body.Bytes())
+	}
+
+	req = httptest.NewRequest("GET", "/admin/console", nil)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if body := resp.Body.String(); resp.Code != http.StatusOK || !strings.Contains(body, "Voting is closed") || !strings.Contains(body, "can no longer be changed") || strings.Contains(body, "open_polls") {
+		t.Fatalf("unexpected console: %s", body)
+	}
+
+	_, records := readAuditRecords(t)
+	var actions []string
+	for _, r := range records {
+		if r.Event == AuditAdminChange {
+			if r.Details["user"] != os.Getenv("REMOTE_USER") {
+				t.Errorf("wrong user: %+v", r)
+			}
+			actions = append(actions, r.Details["action"])
+		}
+	}
+	wantActions := []string{AdminAddCandidate, AdminWithdrawCandidate, AdminEditPosition, AdminEditBio, AdminWithdrawCandidate, AdminClosePolls}
+	if !reflect.DeepEqual(actions, wantActions) {
+		t.Errorf("audited %v; wanted %v", actions, wantActions)
+	}
+}
+
+func TestAdminChangeValidation(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Invalid changes in the database are rejected on startup.
+	change := AdminChange{Action: AdminAddCandidate, Position: "Position 1", Candidate: "Reopen Nominations", User: "test"}
+	if err := s.db.Create(&change).Error; err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := setup(); err == nil || !strings.Contains(err.Error(), "can't be named") {
+		t.Fatalf("expected invalid admin change to be rejected; got %v", err)
+	}
+}
+
+func TestAdminPolls(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+	defer func() { now = time.Now }()
+	c.Admins = []string{"test"}
+
+	change := func(action string) error {
+		return s.makeAdminChange(AdminChange{Action: action, User: "test"})
+	}
+
+	// Opening early keeps the scheduled close.
+	start := time.Now()
+	c.OpensAt = start.Add(time.Hour).Format(time.RFC3339)
+	c.ClosesAt = start.Add(2 * time.Hour).Format(time.RFC3339)
+	if err := change(AdminOpenPolls); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.PollState(start); got != PollOpen {
+		t.Errorf("expected polls to open early; got %q", got)
+	}
+	if got := c.PollState(start.Add(2 * time.Hour)); got != PollClosed {
+		t.Errorf("expected polls to close as scheduled; got %q", got)
+	}
+
+	// Later schedule changes in config.yml still apply.
+	c.ClosesAt = start.Add(3 * time.Hour).Format(time.RFC3339)
+	if got := c.PollState(start.Add(2 * time.Hour)); got != PollOpen {
+		t.Errorf("expected new closing time to apply; got %q", got)
+	}
+	now = func() time.Time { return start.Add(3 * time.Hour) }
+	if err := change(AdminOpenPolls); err == nil || !strings.Contains(err.Error(), "can't be reopened") {
+		t.Errorf("expected polls not to reopen after the scheduled close; got %v", err)
+	}
+	now = time.Now
+
+	// Nothing is committed to before polls first open, so they can still
+	// be opened.
+	c.OpensAt, c.ClosesAt, c.Open, c.PollOverride = "", "", false, ""
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, httptest.NewRequest("GET", "/merkle.json", nil))
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("expected no Merkle root before voting; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	count := 0
+	if err := s.db.Model(&CommitmentRecord{}).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("expected nothing to be committed to; got %d, %v", count, err)
+	}
+	if err := change(AdminOpenPolls); err != nil {
+		t.Fatalf("expected polls to open: %v", err)
+	}
+	if !pollsOpen() {
+		t.Errorf("expected polls to be open")
+	}
+
+	// Once ballots have been cast and polls closed, voting has ended.
+	castVote(t, s, goodForm())
+	c.PollOverride = ""
+	if _, _, err := loadCommitment(s.db); err != nil {
+		t.Fatal(err)
+	}
+	if err := change(AdminOpenPolls); err == nil || !strings.Contains(err.Error(), "can't be reopened") {
+		t.Errorf("expected polls not to reopen after voting ended; got %v", err)
+	}
+	if pollsOpen() {
+		t.Errorf("expected polls to stay closed")
+	}
+}
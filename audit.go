@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Audit log events.
+const (
+	AuditConfigLoaded  = "config_loaded"
+	AuditPollOpened    = "poll_opened"
+	AuditPollClosed    = "poll_closed"
+	AuditVoteAccepted  = "vote_accepted"
+	AuditVoteRejected  = "vote_rejected"
+	AuditResultsViewed = "results_viewed"
+	AuditResultsPublic = "results_published"
+	AuditRollChanged   = "roll_changed"
+	AuditMerkleRoot    = "merkle_root_published"
+	AuditAdminChange   = "admin_change"
+	AuditTokensIssued  = "tokens_issued"
+	AuditInvitations   = "invitations_queued"
+)
+
+// auditSignInterval is how often, in records, the audit log is signed. The
+// poll closing is always signed.
+const auditSignInterval = 20
+
+// AuditRecord is a single event in the audit log. Each record contains the
+// hash of the line before it, so changing or removing any record breaks the
+// chain. Its fields are in alphabetical order so that encoding/json produces
+// the canonical form.
+type AuditRecord struct {
+	Details map[string]string `json:"details,omitempty"`
+	Event   string            `json:"event"`
+	// PrevHash is the hex encoded SHA-256 hash of the previous line, or empty
+	// for the first record.
+	PrevHash string `json:"prev_hash"`
+	Seq      int    `json:"seq"`
+	// Signature, when present, is the RSA-PSS signature of the canonical form
+	// of the record without the signature. Since the record includes the hash
+	// of the previous one, it vouches for the whole log up to this point.
+	Signature string `json:"signature,omitempty"`
+	Time      string `json:"time"`
+}
+
+// hashAuditLine returns the hash used to chain to a line of the audit log.
+func hashAuditLine(line []byte) string {
+	hash := sha256.Sum256(line)
+	return hex.EncodeToString(hash[:])
+}
+
+// signingBytes returns the canonical form of the record without its
+// signature.
+func (r AuditRecord) signingBytes() ([]byte, error) {
+	r.Signature = ""
+	return json.Marshal(r)
+}
+
+// readAuditLines returns the non-empty lines of an audit log.
+func readAuditLines(r io.Reader) ([][]byte, error) {
+	var lines [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		lines = append(lines, append([]byte(nil), line...))
+	}
+	return lines, scanner.Err()
+}
+
+// appendAudit locks the audit log and appends the records returned by f,
+// which is given the records already in the log. It does nothing if no audit
+// log is configured.
+func appendAudit(f func(prev []AuditRecord) []AuditRecord) error {
+	if c.AuditLog == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(c.AuditLog, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "audit log %q", c.AuditLog)
+	}
+	defer file.Close()
+	// Several copies of the CGI program may be running at once.
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "locking audit log %q", c.AuditLog)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	lines, err := readAuditLines(file)
+	if err != nil {
+		return errors.Wrapf(err, "audit log %q", c.AuditLog)
+	}
+	var prev []AuditRecord
+	for i, line := range lines {
+		var r AuditRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return errors.Wrapf(err, "audit log %q: line %d", c.AuditLog, i+1)
+		}
+		prev = append(prev, r)
+	}
+
+	records := f(prev)
+	if len(records) == 0 {
+		return nil
+	}
+
+	var key *rsa.PrivateKey
+	prevHash, seq := "", 0
+	if len(lines) > 0 {
+		prevHash = hashAuditLine(lines[len(lines)-1])
+		seq = prev[len(prev)-1].Seq
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		seq++
+		r.Seq = seq
+		r.PrevHash = prevHash
+		r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+		if seq%auditSignInterval == 0 || r.Event == AuditPollClosed {
+			if key == nil {
+				if key, err = loadPrivateKey(c.PrivateKey); err != nil {
+					return err
+				}
+			}
+			msg, err := r.signingBytes()
+			if err != nil {
+				return err
+			}
+			if r.Signature, err = signPSS(key, msg); err != nil {
+				return err
+			}
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		prevHash = hashAuditLine(line)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	_, err = file.Write(buf.Bytes())
+	return err
+}
+
+// audit appends an event to the audit log. Failures are logged rather than
+// returned since the event has already happened.
+func audit(event string, details map[string]string) {
+	if err := appendAudit(func([]AuditRecord) []AuditRecord {
+		return []AuditRecord{{Event: event, Details: details}}
+	}); err != nil {
+		log.Printf("Error: audit %s: %+v", event, err)
+	}
+}
+
+// auditStartup records changes to the configuration, the state of the poll and
+// the voter roll since they were last recorded. Since this is a CGI program,
+// the configuration is reloaded on every request, so only changes are
+// recorded.
+func auditStartup() error {
+	config, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	configHash := sha256.Sum256(config)
+
+	rollHash := ""
+	if roll, err := ioutil.ReadFile(c.StudentIDs); err == nil {
+		hash := sha256.Sum256(roll)
+		rollHash = hex.EncodeToString(hash[:])
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return appendAudit(func(prev []AuditRecord) []AuditRecord {
+		lastConfig, lastRoll := "", ""
+		var open *bool
+		for _, r := range prev {
+			switch r.Event {
+			case AuditConfigLoaded:
+				lastConfig = r.Details["sha256"]
+			case AuditRollChanged:
+				if r.Details["source"] == "studentids" {
+					lastRoll = r.Details["sha256"]
+				}
+			case AuditPollOpened, AuditPollClosed:
+				isOpen := r.Event == AuditPollOpened
+				open = &isOpen
+			}
+		}
+
+		var records []AuditRecord
+		if hash := hex.EncodeToString(configHash[:]); hash != lastConfig {
+			records = append(records, AuditRecord{
+				Event:   AuditConfigLoaded,
+				Details: map[string]string{"election_id": c.ElectionID, "sha256": hash},
+			})
+		}
+		if rollHash != "" && rollHash != lastRoll {
+			records = append(records, AuditRecord{
+				Event:   AuditRollChanged,
+				Details: map[string]string{"sha256": rollHash, "source": "studentids"},
+			})
+		}
+		// Only record the poll closing if it was opened.
+		if isOpen := pollsOpen(); (open == nil && isOpen) || (open != nil && *open != isOpen) {
+			event := AuditPollClosed
+			if isOpen {
+				event = AuditPollOpened
+			}
+			records = append(records, AuditRecord{Event: event})
+		}
+		return records
+	})
+}
+
+// auditReport is the result of checking an audit log.
+type auditReport struct {
+	Records int
+	Signed  int
+	// LastSigned is the sequence number of the last signed record.
+	LastSigned int
+	// Problems are the breaks in the chain that were found.
+	Problems []string
+}
+
+// verifyAudit walks the audit log checking the hash chain and signatures.
+func verifyAudit(pub *rsa.PublicKey, r io.Reader) (*auditReport, error) {
+	lines, err := readAuditLines(r)
+	if err != nil {
+		return nil, err
+	}
+	report := &auditReport{Records: len(lines)}
+	problem := func(line int, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+	}
+	prevHash, prevSeq := "", 0
+	for i, line := range lines {
+		n := i + 1
+		var rec AuditRecord
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rec); err != nil {
+			problem(n, "invalid record: %s", err)
+			prevHash, prevSeq = hashAuditLine(line), prevSeq+1
+			continue
+		}
+		if rec.PrevHash != prevHash {
+			problem(n, "previous hash %q does not match %q", rec.PrevHash, prevHash)
+		}
+		if rec.Seq != prevSeq+1 {
+			problem(n, "sequence number %d follows %d", rec.Seq, prevSeq)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, rec.Time); err != nil {
+			problem(n, "invalid time %q", rec.Time)
+		}
+		if rec.Signature != "" {
+			msg, err := rec.signingBytes()
+			if err != nil {
+				return nil, err
+			}
+			if err := verifyPSS(pub, msg, rec.Signature); err != nil {
+				problem(n, "%s", err)
+			} else {
+				report.Signed++
+				report.LastSigned = rec.Seq
+			}
+		}
+		prevHash, prevSeq = hashAuditLine(line), rec.Seq
+	}
+	return report, nil
+}
+
+// runAudit implements the audit command.
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	pubKey := fs.String("pubkey", "", "the public key to verify against, as served at /pubkey (defaults to the key in config.yml)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections audit verify [-pubkey pubkey.pem] [audit.log]\n")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "verify" {
+		fs.Usage()
+		return errors.New("expected verify")
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one audit log")
+	}
+
+	path := fs.Arg(0)
+	var pub *rsa.PublicKey
+	if *pubKey != "" {
+		var err error
+		pub, err = loadPublicKey(*pubKey)
+		if err != nil {
+			return err
+		}
+	}
+	if pub == nil || path == "" {
+		if err := loadConfig(); err != nil {
+			return err
+		}
+		if path == "" {
+			path = c.AuditLog
+		}
+		if pub == nil {
+			key, err := loadPrivateKey(c.PrivateKey)
+			if err != nil {
+				return err
+			}
+			pub = &key.PublicKey
+		}
+	}
+	if path == "" {
+		return errors.New("no audit log given and auditlog not set in config.yml")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report, err := verifyAudit(pub, f)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d records, %d signed.\n", report.Records, report.Signed)
+	if unsigned := report.Records - report.LastSigned; unsigned > 0 && len(report.Problems) == 0 {
+		fmt.Printf("The last %d records are not yet covered by a signature.\n", unsigned)
+	}
+	if len(report.Problems) > 0 {
+		return errors.Errorf("audit log %q has %d problems", path, len(report.Problems))
+	}
+	fmt.Println("Audit log chain intact.")
+	return nil
+}
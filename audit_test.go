@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAuditRecords(t *testing.T) ([][]byte, []AuditRecord) {
+	f, err := os.Open(c.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines, err := readAuditLines(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []AuditRecord
+	for _, line := range lines {
+		var r AuditRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return lines, records
+}
+
+func TestAuditLog(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	castVote(t, s, goodForm())
+
+	req := httptest.NewRequest("POST", "/vote", nil)
+	req.Form = goodForm()
+	addCSRF(t, req)
+	s.mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	c.Admins = []string{"test"}
+	s.mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin", nil))
+
+	// Reloading records the change to admins, then nothing more until the
+	// poll closes.
+	if err := auditStartup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditStartup(); err != nil {
+		t.Fatal(err)
+	}
+	c.Open = false
+	if err := auditStartup(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, records := readAuditRecords(t)
+	var events []string
+	for _, r := range records {
+		events = append(events, r.Event)
+	}
+	want := []string{
+		AuditConfigLoaded, AuditRollChanged, AuditPollOpened,
+		AuditVoteAccepted, AuditVoteRejected, AuditResultsViewed,
+		AuditConfigLoaded, AuditConfigLoaded, AuditPollClosed,
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %+v; wanted %+v", events, want)
+	}
+	if got := records[4].Details["reason"]; !strings.Contains(got, "already voted") {
+		t.Errorf("got rejection reason %q", got)
+	}
+	if records[8].Signature == "" {
+		t.Errorf("poll closing not signed")
+	}
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile(c.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := verifyAudit(&key.PublicKey, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) > 0 || report.Records != 9 || report.Signed != 1 || report.LastSigned != 9 {
+		t.Fatalf("got report %+v", report)
+	}
+
+	// Tampering with a record breaks the chain at the next one.
+	tampered := bytes.Replace(body, []byte(`"user":"test"`), []byte(`"user":"evil"`), 1)
+	report, err = verifyAudit(&key.PublicKey, bytes.NewReader(tampered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || !strings.HasPrefix(report.Problems[0], "line 5: previous hash") {
+		t.Fatalf("got problems %+v", report.Problems)
+	}
+
+	// Removing a record breaks the chain and the sequence.
+	lines := bytes.SplitAfter(body, []byte("\n"))
+	removed := bytes.Join(append(lines[:2:2], lines[3:]...), nil)
+	report, err = verifyAudit(&key.PublicKey, bytes.NewReader(removed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 2 {
+		t.Fatalf("got problems %+v", report.Problems)
+	}
+}
+
+func TestAuditSignInterval(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	for i := 0; i < auditSignInterval; i++ {
+		audit(AuditResultsViewed, nil)
+	}
+	lines, records := readAuditRecords(t)
+	for i, r := range records {
+		if signed := r.Signature != ""; signed != (r.Seq == auditSignInterval) {
+			t.Errorf("%d. seq %d signed = %t", i, r.Seq, signed)
+		}
+	}
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := verifyAudit(&key.PublicKey, bytes.NewReader(bytes.Join(lines, []byte("\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) > 0 || report.LastSigned != auditSignInterval {
+		t.Fatalf("got report %+v", report)
+	}
+}
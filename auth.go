@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Authentication methods.
+const (
+	AuthCGI    = "cgi"
+	AuthHeader = "header"
+	AuthBasic  = "basic"
+	AuthOIDC   = "oidc"
+)
+
+// AuthConfig is how voters and admins log in.
+type AuthConfig struct {
+	// Method is one of cgi (the default), header, basic or oidc.
+	Method string
+	// Header is the header a trusted reverse proxy sets to the logged in
+	// user, for the header method.
+	Header string
+	// TrustedProxies are the addresses or CIDR ranges of the reverse
+	// proxies allowed to set Header. They're required when running as a
+	// CGI script; with -listen, only loopback addresses are trusted by
+	// default.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Htpasswd is the path of the password file for the basic method, and
+	// Realm is shown when the browser asks for a password.
+	Htpasswd string
+	Realm    string
+	OIDC     OIDCConfig
+}
+
+// OIDCConfig configures logging in with an OpenID Connect provider's
+// authorization code flow.
+type OIDCConfig struct {
+	AuthURL     string `yaml:"auth_url"`
+	TokenURL    string `yaml:"token_url"`
+	UserInfoURL string `yaml:"userinfo_url"`
+	ClientID    string `yaml:"client_id"`
+	// ClientSecret is the path of the file containing the client secret.
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the full URL of elections.cgi/login/callback.
+	RedirectURL string `yaml:"redirect_url"`
+	Scopes      []string
+	// UsernameClaim is the user info claim holding the username, by
+	// default preferred_username.
+	UsernameClaim string `yaml:"username_claim"`
+	// SessionSecret is the path of the secret key used to sign session
+	// cookies.
+	SessionSecret string `yaml:"session_secret"`
+}
+
+// Authenticator finds the logged in user making a request.
+type Authenticator interface {
+	// User returns the logged in user, or "" if the request isn't logged in.
+	User(r *http.Request) (string, error)
+	// Login responds to a request that isn't logged in, e.g. by asking for a
+	// password or redirecting to a login page.
+	Login(w http.ResponseWriter, r *http.Request)
+}
+
+// newAuthenticator returns the authenticator configured in config.yml, or
+// for the header set with -authheader.
+func newAuthenticator() (Authenticator, error) {
+	if *authHeader != "" {
+		return newHeaderAuth(*authHeader)
+	}
+	switch c.Auth.Method {
+	case "", AuthCGI:
+		return cgiAuth{}, nil
+	case AuthHeader:
+		if c.Auth.Header == "" {
+			return nil, errors.New("auth: header is required for the header method")
+		}
+		return newHeaderAuth(c.Auth.Header)
+	case AuthBasic:
+		if c.Auth.Htpasswd == "" {
+			return nil, errors.New("auth: htpasswd is required for the basic method")
+		}
+		return basicAuth{htpasswd: c.Auth.Htpasswd, realm: c.Auth.Realm}, nil
+	case AuthOIDC:
+		return newOIDCAuth(c.Auth.OIDC)
+	}
+	return nil, errors.Errorf("auth: unknown method %q, expected %s, %s, %s or %s", c.Auth.Method, AuthCGI, AuthHeader, AuthBasic, AuthOIDC)
+}
+
+// remoteUserKey is the request context key of the logged in user.
+type remoteUserKey struct{}
+
+// remoteUser returns the logged in user making a request, as found by the
+// server's authenticator.
+func remoteUser(r *http.Request) string {
+	user, _ := r.Context().Value(remoteUserKey{}).(string)
+	return user
+}
+
+// login wraps a handler for a page that needs a logged in user. The user is
+// found by the server's authenticator and can be read with remoteUser.
+func (s *server) login(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.auth.User(r)
+		if err != nil {
+			notLoggedIn(w, r, err)
+			return
+		}
+		if user == "" {
+			s.auth.Login(w, r)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), remoteUserKey{}, user)))
+	}
+}
+
+// notLoggedIn responds with an error page explaining why the request isn't
+// logged in.
+func notLoggedIn(w http.ResponseWriter, r *http.Request, err error) {
+	handleErr(func(w *TemplateWriter, r *http.Request) error {
+		return err
+	})(w, r)
+}
+
+// cgiAuth takes the user from REMOTE_USER, set by the web server running the
+// CGI script, e.g. Apache with .htaccess LDAP authentication.
+type cgiAuth struct{}
+
+// User implements Authenticator.
+func (cgiAuth) User(r *http.Request) (string, error) {
+	return os.Getenv("REMOTE_USER"), nil
+}
+
+// Login implements Authenticator. The web server should have required a
+// login before running the script, so this is an error.
+func (cgiAuth) Login(w http.ResponseWriter, r *http.Request) {
+	notLoggedIn(w, r, errors.New("missing REMOTE_USER"))
+}
+
+// headerAuth takes the user from a header set by a trusted reverse proxy.
+type headerAuth struct {
+	header string
+	// trusted are the addresses requests may come from.
+	trusted []*net.IPNet
+}
+
+// trustedProxyList returns the proxies set with -trustedproxies, or else in
+// config.yml.
+func trustedProxyList() []string {
+	if *trustedProxies != "" {
+		return strings.Split(*trustedProxies, ",")
+	}
+	return c.Auth.TrustedProxies
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if strings.Contains(proxy, "/") {
+			_, n, err := net.ParseCIDR(proxy)
+			if err != nil {
+				return nil, errors.Wrapf(err, "trusted proxy %q", proxy)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, errors.Errorf("trusted proxy %q: invalid address", proxy)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// newHeaderAuth returns a headerAuth for header. Only requests from the
+// trusted proxies can log in, since anyone else who can reach the server could
+// set the header. With -listen, loopback addresses are trusted if none are
+// set. As a CGI script, REMOTE_ADDR is checked instead, and the proxies must
+// be set, since the web server passes on headers from any client.
+func newHeaderAuth(header string) (Authenticator, error) {
+	proxies := trustedProxyList()
+	if len(proxies) == 0 {
+		if *listen == "" {
+			return nil, errors.New("auth: trusted_proxies is required for the header method when running as a CGI script")
+		}
+		proxies = []string{"127.0.0.0/8", "::1"}
+	}
+	trusted, err := parseTrustedProxies(proxies)
+	if err != nil {
+		return nil, err
+	}
+	return headerAuth{header: header, trusted: trusted}, nil
+}
+
+// User implements Authenticator.
+func (a headerAuth) User(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	trusted := false
+	for _, n := range a.trusted {
+		trusted = trusted || (ip != nil && n.Contains(ip))
+	}
+	if !trusted {
+		return "", errors.Errorf("requests from %s can't log in with the %s header because it isn't a trusted proxy", host, a.header)
+	}
+	return strings.TrimSpace(r.Header.Get(a.header)), nil
+}
+
+// Login implements Authenticator. The proxy should have required a login,
+// so this is an error.
+func (a headerAuth) Login(w http.ResponseWriter, r *http.Request) {
+	notLoggedIn(w, r, errors.Errorf("missing %s header", a.header))
+}
+
+// basicAuth checks HTTP basic authentication against an htpasswd file, which
+// is reread on each request so users can be added without a restart.
+type basicAuth struct {
+	htpasswd string
+	realm    string
+}
+
+// User implements Authenticator. Wrong passwords are treated as not logged
+// in so the browser asks again.
+func (a basicAuth) User(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	hashes, err := loadHtpasswd(a.htpasswd)
+	if err != nil {
+		return "", err
+	}
+	hash, ok := hashes[user]
+	if !ok {
+		log.Printf("basic auth: unknown user %q", user)
+		return "", nil
+	}
+	match, err := checkHtpasswd(hash, password)
+	if err != nil {
+		return "", errors.Wrapf(err, "file %q: user %q", a.htpasswd, user)
+	}
+	if !match {
+		log.Printf("basic auth: wrong password for %q", user)
+		return "", nil
+	}
+	return user, nil
+}
+
+// Login implements Authenticator.
+func (a basicAuth) Login(w http.ResponseWriter, r *http.Request) {
+	realm := a.realm
+	if realm == "" {
+		realm = "Elections"
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	http.Error(w, "You need to log in to vote.", http.StatusUnauthorized)
+}
+
+// loadHtpasswd reads the password hashes from an htpasswd file.
+func loadHtpasswd(path string) (map[string]string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file %q", path)
+	}
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("file %q: expected user:hash, got %q", path, line)
+		}
+		hashes[parts[0]] = parts[1]
+	}
+	return hashes, scanner.Err()
+}
+
+// checkHtpasswd checks a password against an htpasswd hash. Apache MD5
+// ($apr1$, htpasswd -m) and SHA-1 ({SHA}, htpasswd -s) hashes are supported.
+func checkHtpasswd(hash, password string) (bool, error) {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false, errors.New("unsupported password hash, create it with htpasswd -m")
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+}
+
+// apr1 returns the Apache MD5 crypt hash of a password.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := 16
+		if i < n {
+			n = i
+		}
+		d.Write(alt[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	to64(uint(final[11]), 2)
+	return out.String()
+}
+
+// OIDC cookies and paths.
+const (
+	oidcCallbackPath  = "/login/callback"
+	oidcStateCookie   = "elections_login"
+	oidcSessionCookie = "elections_session"
+	// oidcSessionLifetime is how long a login lasts.
+	oidcSessionLifetime = time.Hour
+)
+
+// oidcAuth logs users in with an OpenID Connect provider's authorization
+// code flow, and keeps them logged in with a signed session cookie.
+type oidcAuth struct {
+	config       OIDCConfig
+	clientSecret string
+	secret       []byte
+	// cookiePath scopes the cookies to the script.
+	cookiePath string
+	secure     bool
+	client     *http.Client
+}
+
+func newOIDCAuth(config OIDCConfig) (*oidcAuth, error) {
+	for field, value := range map[string]string{
+		"auth_url":       config.AuthURL,
+		"token_url":      config.TokenURL,
+		"userinfo_url":   config.UserInfoURL,
+		"client_id":      config.ClientID,
+		"redirect_url":   config.RedirectURL,
+		"session_secret": config.SessionSecret,
+	} {
+		if value == "" {
+			return nil, errors.Errorf("auth: oidc: %s is required", field)
+		}
+	}
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "auth: oidc: redirect_url")
+	}
+	if !strings.HasSuffix(redirect.Path, oidcCallbackPath) {
+		return nil, errors.Errorf("auth: oidc: redirect_url must end in %s", oidcCallbackPath)
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile"}
+	}
+
+	a := &oidcAuth{
+		config:     config,
+		cookiePath: strings.TrimSuffix(redirect.Path, oidcCallbackPath),
+		secure:     redirect.Scheme == "https",
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if a.cookiePath == "" {
+		a.cookiePath = "/"
+	}
+	if a.secret, err = loadSecret(config.SessionSecret, "session secret"); err != nil {
+		return nil, errors.Wrap(err, "auth: oidc")
+	}
+	if config.ClientSecret != "" {
+		body, err := ioutil.ReadFile(config.ClientSecret)
+		if err != nil {
+			return nil, errors.Wrap(err, "auth: oidc: client_secret")
+		}
+		a.clientSecret = strings.TrimSpace(string(body))
+	}
+	return a, nil
+}
+
+// sign returns the HMAC of value with the session secret.
+func (a *oidcAuth) sign(value string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// User implements Authenticator.
+func (a *oidcAuth) User(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(a.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return "", nil
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now().Unix() >= expires {
+		return "", nil
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil
+	}
+	return string(user), nil
+}
+
+// Login implements Authenticator by redirecting to the provider. The state
+// sent to the provider is also kept in a cookie along with the page to return
+// to, so the callback can check that it started the login.
+func (a *oidcAuth) Login(w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		notLoggedIn(w, r, err)
+		return
+	}
+	state := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + base64.RawURLEncoding.EncodeToString([]byte(r.RequestURI)),
+		Path:     a.cookiePath,
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   a.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", a.config.ClientID)
+	query.Set("redirect_uri", a.config.RedirectURL)
+	query.Set("scope", strings.Join(a.config.Scopes, " "))
+	query.Set("state", state)
+	sep := "?"
+	if strings.Contains(a.config.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, a.config.AuthURL+sep+query.Encode(), http.StatusFound)
+}
+
+// handleCallback finishes logging in when the provider redirects back with
+// an authorization code.
+func (a *oidcAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	handleErr(func(w *TemplateWriter, r *http.Request) error {
+		if msg := r.FormValue("error"); msg != "" {
+			return errors.Errorf("Logging in failed: %s", msg)
+		}
+		cookie, err := r.Cookie(oidcStateCookie)
+		if err != nil {
+			return errors.New("Logging in took too long or cookies are disabled. Please try again.")
+		}
+		parts := strings.SplitN(cookie.Value, ".", 2)
+		state := r.FormValue("state")
+		if len(parts) != 2 || state == "" || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+			return errors.New("Invalid login state. Please try again.")
+		}
+		returnTo, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || !strings.HasPrefix(string(returnTo), "/") || strings.HasPrefix(string(returnTo), "//") {
+			returnTo = []byte(a.cookiePath)
+		}
+
+		user, err := a.exchange(r.Context(), r.FormValue("code"))
+		if err != nil {
+			return err
+		}
+
+		expires := strconv.FormatInt(now().Add(oidcSessionLifetime).Unix(), 10)
+		value := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + expires
+		http.SetCookie(w, &http.Cookie{
+			Name:   oidcStateCookie,
+			Path:   a.cookiePath,
+			MaxAge: -1,
+		})
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcSessionCookie,
+			Value:    value + "." + a.sign(value),
+			Path:     a.cookiePath,
+			MaxAge:   int(oidcSessionLifetime.Seconds()),
+			HttpOnly: true,
+			Secure:   a.secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, string(returnTo), http.StatusFound)
+		return nil
+	})(w, r)
+}
+
+// exchange trades an authorization code for an access token, and returns the
+// username from the provider's user info.
+func (a *oidcAuth) exchange(ctx context.Context, code string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing authorization code")
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", a.config.RedirectURL)
+	form.Set("client_id", a.config.ClientID)
+	if a.clientSecret != "" {
+		form.Set("client_secret", a.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := a.doJSON(req, &token); err != nil {
+		return "", errors.Wrap(err, "token request")
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token request: missing access_token")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", a.config.UserInfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	var claims map[string]interface{}
+	if err := a.doJSON(req, &claims); err != nil {
+		return "", errors.Wrap(err, "user info request")
+	}
+	user, _ := claims[a.config.UsernameClaim].(string)
+	if user == "" {
+		return "", errors.Errorf("user info request: missing %s claim", a.config.UsernameClaim)
+	}
+	return user, nil
+}
+
+// doJSON sends a request to the provider and decodes its JSON response.
+func (a *oidcAuth) doJSON(req *http.Request, v interface{}) error {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHtpasswd(t *testing.T) {
+	cases := []struct {
+		hash, password string
+		want           bool
+	}{
+		// openssl passwd -apr1 -salt saltsalt secret
+		{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true},
+		{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "Secret", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "wrong", false},
+	}
+	for _, tc := range cases {
+		got, err := checkHtpasswd(tc.hash, tc.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("checkHtpasswd(%q, %q) = %v", tc.hash, tc.password, got)
+		}
+	}
+	if _, err := checkHtpasswd("$2y$05$abcdefghijklmnopqrstuu", "secret"); err == nil {
+		t.Errorf("expected error for bcrypt hash")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	htpasswd := filepath.Join(filepath.Dir(c.DBPath), ".htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("# voters\ntest:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.Auth = AuthConfig{Method: AuthBasic, Htpasswd: htpasswd}
+	auth, err := newAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = auth
+	os.Setenv("REMOTE_USER", "")
+	defer os.Setenv("REMOTE_USER", "test")
+
+	for _, tc := range []struct {
+		user, password string
+		want           int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"test", "wrong", http.StatusUnauthorized},
+		{"other", "secret", http.StatusUnauthorized},
+		{"test", "secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != tc.want {
+			t.Errorf("%s:%s: got status %d; wanted %d", tc.user, tc.password, resp.Code, tc.want)
+		}
+		if resp.Code == http.StatusUnauthorized && !strings.HasPrefix(resp.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("expected basic auth challenge; got %q", resp.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestHeaderAuth(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+	*listen = "127.0.0.1:0"
+	defer func() { *listen = "" }()
+	c.Auth = AuthConfig{Method: AuthHeader, Header: "X-Remote-User"}
+	os.Setenv("REMOTE_USER", "")
+	defer os.Setenv("REMOTE_USER", "test")
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		auth, err := newAuthenticator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.auth = auth
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Remote-User", "test")
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Only loopback addresses are trusted by default.
+	if resp := get("192.0.2.1:1234"); resp.Code != http.StatusInternalServerError || !strings.Contains(html.UnescapeString(resp.Body.String()), "isn't a trusted proxy") {
+		t.Errorf("expected header from another address to be rejected; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	if resp := get("127.0.0.1:1234"); resp.Code != http.StatusOK {
+		t.Errorf("expected header from loopback to be accepted; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	c.Auth.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	if resp := get("192.0.2.1:1234"); resp.Code != http.StatusOK {
+		t.Errorf("expected header from trusted proxy to be accepted; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	if resp := get("127.0.0.1:1234"); resp.Code != http.StatusInternalServerError {
+		t.Errorf("expected loopback not to be trusted with an allowlist; got %d", resp.Code)
+	}
+
+	// Listening beyond loopback requires an allowlist.
+	c.Auth.TrustedProxies = nil
+	if err := s.listenAndServe("0.0.0.0:0"); err == nil || !strings.Contains(err.Error(), "requires -trustedproxies") {
+		t.Errorf("expected listening on all addresses to be refused; got %v", err)
+	}
+
+	// As a CGI script the proxies must be set, and REMOTE_ADDR is checked.
+	*listen = ""
+	if _, err := newAuthenticator(); err == nil || !strings.Contains(err.Error(), "trusted_proxies is required") {
+		t.Errorf("expected header auth without trusted proxies to be refused; got %v", err)
+	}
+	c.Auth.TrustedProxies = []string{"10.0.0.5"}
+	if resp := get("192.0.2.1:1234"); resp.Code != http.StatusInternalServerError {
+		t.Errorf("expected header from another address to be rejected; got %d", resp.Code)
+	}
+	if resp := get("10.0.0.5:1234"); resp.Code != http.StatusOK {
+		t.Errorf("expected header from trusted proxy to be accepted; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+}
+
+func TestOIDCAuth(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	// A stub provider that issues a token for one code, and says the token
+	// belongs to "test".
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.FormValue("code") != "good-code" || r.FormValue("client_secret") != "client-secret" || r.FormValue("grant_type") != "authorization_code" {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token": "token", "token_type": "Bearer"}`))
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"sub": "1234", "preferred_username": "test"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer provider.Close()
+
+	dir := filepath.Dir(c.DBPath)
+	for name, secret := range map[string]string{"client_secret": "client-secret\n", "session_secret": "0123456789abcdef0123456789abcdef"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(secret), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Auth = AuthConfig{
+		Method: AuthOIDC,
+		OIDC: OIDCConfig{
+			AuthURL:       provider.URL + "/authorize",
+			TokenURL:      provider.URL + "/token",
+			UserInfoURL:   provider.URL + "/userinfo",
+			ClientID:      "elections",
+			ClientSecret:  filepath.Join(dir, "client_secret"),
+			RedirectURL:   "https://example.com/~csss/elections.cgi/login/callback",
+			SessionSecret: filepath.Join(dir, "session_secret"),
+		},
+	}
+	os.Setenv("REMOTE_USER", "")
+	defer os.Setenv("REMOTE_USER", "test")
+	s, err := setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	get := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+	cookie := func(resp *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, cookie := range resp.Result().Cookies() {
+			if cookie.Name == name {
+				return cookie
+			}
+		}
+		t.Fatalf("missing cookie %q", name)
+		return nil
+	}
+
+	resp := get("/")
+	if resp.Code != http.StatusFound {
+		t.Fatalf("expected redirect to the provider; got %d", resp.Code)
+	}
+	location, err := url.Parse(resp.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if !strings.HasPrefix(location.String(), provider.URL+"/authorize?") || query.Get("client_id") != "elections" || query.Get("redirect_uri") != c.Auth.OIDC.RedirectURL {
+		t.Fatalf("unexpected redirect %s", location)
+	}
+	state := cookie(resp, oidcStateCookie)
+	if state.Path != "/~csss/elections.cgi" || !state.Secure || !state.HttpOnly {
+		t.Errorf("unexpected state cookie %+v", state)
+	}
+
+	// Errors from the provider are shown escaped.
+	if resp := get("/login/callback?error=" + url.QueryEscape("<script>alert(1)</script>")); resp.Code != http.StatusInternalServerError || strings.Contains(resp.Body.String(), "<script>alert") || !strings.Contains(resp.Body.String(), "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("expected login error to be escaped; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	if resp := get("/login/callback?code=good-code&state=forged", state); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "Invalid login state") {
+		t.Errorf("expected forged state to be rejected; got %d", resp.Code)
+	}
+	if resp := get("/login/callback?code=bad-code&state="+query.Get("state"), state); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "invalid_grant") {
+		t.Errorf("expected bad code to be rejected; got %d", resp.Code)
+	}
+
+	resp = get("/login/callback?code=good-code&state="+query.Get("state"), state)
+	if resp.Code != http.StatusFound || resp.Header().Get("Location") != "/" {
+		t.Fatalf("expected redirect back; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	session := cookie(resp, oidcSessionCookie)
+
+	if resp := get("/", session); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %d: %s", resp.Code, resp.Body.Bytes())
+	}
+
+	tampered := *session
+	tampered.Value = strings.Replace(session.Value, session.Value[:4], "b3Ro", 1)
+	if resp := get("/", &tampered); resp.Code != http.StatusFound {
+		t.Errorf("expected tampered session to log in again; got %d", resp.Code)
+	}
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().Add(2 * oidcSessionLifetime) }
+	if resp := get("/", session); resp.Code != http.StatusFound {
+		t.Errorf("expected expired session to log in again; got %d", resp.Code)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// BallotRecord is a ballot as stored in the database, holding all of a voter's
+// choices. It deliberately has no timestamps and a random primary key, and the
+// table is created WITHOUT ROWID so rows are stored in key order. Together
+// this means ballots can't be linked to voters by when or in what order they
+// were inserted.
+type BallotRecord struct {
+	ID      string `gorm:"primary_key"`
+	Tracker string
+	// Ballot is the JSON encoded Ballot.
+	Ballot string
+}
+
+// TableName implements gorm.tabler.
+func (BallotRecord) TableName() string {
+	return "ballots"
+}
+
+const createBallotsTable = `CREATE TABLE IF NOT EXISTS ballots (
+	id varchar(32) PRIMARY KEY,
+	tracker varchar(32) NOT NULL UNIQUE,
+	ballot text NOT NULL
+) WITHOUT ROWID`
+
+// newBallotID returns a random primary key for a ballot.
+func newBallotID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// insertBallot stores a ballot.
+func insertBallot(tx *gorm.DB, ballot *Ballot) error {
+	id, err := newBallotID()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(ballot)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&BallotRecord{
+		ID:      id,
+		Tracker: ballot.Tracker,
+		Ballot:  string(body),
+	}).Error
+}
+
+// loadBallots returns every stored ballot sorted by tracker code.
+func loadBallots(db *gorm.DB) ([]*Ballot, error) {
+	var records []BallotRecord
+	if err := db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	var ballots []*Ballot
+	for _, r := range records {
+		var b Ballot
+		if err := json.Unmarshal([]byte(r.Ballot), &b); err != nil {
+			return nil, errors.Wrapf(err, "ballot %s", r.ID)
+		}
+		ballots = append(ballots, &b)
+	}
+	sort.Slice(ballots, func(i, j int) bool {
+		return ballots[i].Tracker < ballots[j].Tracker
+	})
+	return ballots, nil
+}
+
+// legacyVote is a single position's choices from before ballots were stored
+// as one row per voter.
+type legacyVote struct {
+	gorm.Model
+
+	Tracker   string
+	Position  string
+	Candidate string
+}
+
+func (legacyVote) TableName() string {
+	return "votes"
+}
+
+// legacyReferendumVote is a single referendum answer from before ballots were
+// stored as one row per voter.
+type legacyReferendumVote struct {
+	gorm.Model
+
+	Tracker  string
+	Question string
+	Choice   string
+}
+
+func (legacyReferendumVote) TableName() string {
+	return "referendum_votes"
+}
+
+// migrateLegacyVotes moves votes from the old per-position votes and
+// referendum_votes tables into ballots and drops the old tables. Votes that
+// share a tracker code are grouped into one ballot. Votes cast before tracker
+// codes existed were stored in the same transaction as their voter, so each
+// is grouped with the voter created most recently before it. A vote that
+// can't be matched this way, because there is no earlier voter or that
+// voter's ballot already has an answer for its position, becomes a ballot of
+// its own with a new tracker code, and how many did is logged.
+func migrateLegacyVotes(db *gorm.DB) error {
+	if !db.HasTable(&legacyVote{}) && !db.HasTable(&legacyReferendumVote{}) {
+		return nil
+	}
+
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	ballots := map[string]*Ballot{}
+	get := func(key, tracker string) *Ballot {
+		b, ok := ballots[key]
+		if !ok {
+			b = &Ballot{
+				Positions:   map[string][]string{},
+				Referendums: map[string]string{},
+				Tracker:     tracker,
+			}
+			ballots[key] = b
+		}
+		return b
+	}
+
+	var voters []Voter
+	if err := tx.Unscoped().Order("created_at").Find(&voters).Error; err != nil {
+		return err
+	}
+	// voterAt returns the key of the ballot of the voter created most
+	// recently at or before t.
+	voterAt := func(t time.Time) string {
+		i := sort.Search(len(voters), func(i int) bool {
+			return voters[i].CreatedAt.After(t)
+		})
+		if i == 0 {
+			return ""
+		}
+		return "voter:" + voters[i-1].Username
+	}
+	migrated, unmatched := 0, 0
+
+	if tx.HasTable(&legacyVote{}) {
+		var votes []legacyVote
+		if err := tx.Unscoped().Order("id").Find(&votes).Error; err != nil {
+			return err
+		}
+		for _, v := range votes {
+			var candidates []string
+			if err := json.Unmarshal([]byte(v.Candidate), &candidates); err != nil {
+				return errors.Wrapf(err, "vote %d", v.ID)
+			}
+			key := v.Tracker
+			if key == "" {
+				key = voterAt(v.CreatedAt)
+				if b, ok := ballots[key]; key == "" || (ok && b.Positions[v.Position] != nil) {
+					key = fmt.Sprintf("vote-%d", v.ID)
+					unmatched++
+				}
+			}
+			get(key, v.Tracker).Positions[v.Position] = candidates
+			migrated++
+		}
+	}
+	if tx.HasTable(&legacyReferendumVote{}) {
+		var answers []legacyReferendumVote
+		if err := tx.Unscoped().Order("id").Find(&answers).Error; err != nil {
+			return err
+		}
+		for _, a := range answers {
+			key := a.Tracker
+			if key == "" {
+				key = voterAt(a.CreatedAt)
+				if b, ok := ballots[key]; key == "" || (ok && b.Referendums[a.Question] != "") {
+					key = fmt.Sprintf("referendum-%d", a.ID)
+					unmatched++
+				}
+			}
+			get(key, a.Tracker).Referendums[a.Question] = a.Choice
+			migrated++
+		}
+	}
+
+	for _, b := range ballots {
+		if b.Tracker == "" {
+			tracker, err := newTracker()
+			if err != nil {
+				return err
+			}
+			b.Tracker = tracker
+		}
+		if err := insertBallot(tx, b); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.DropTableIfExists(&legacyVote{}, &legacyReferendumVote{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Printf("migrated %d legacy votes into %d ballots", migrated, len(ballots))
+	if unmatched > 0 {
+		log.Printf("%d legacy votes couldn't be matched to a voter and were migrated as ballots of their own, so there are more ballots than voters", unmatched)
+	}
+
+	// Rewrite the database file so the dropped rows don't linger in free
+	// pages.
+	return db.Exec("VACUUM").Error
+}
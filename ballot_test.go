@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestMigrateLegacyVotes(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Votes without trackers are grouped by the voter created just before
+	// them.
+	start := time.Now().Add(-time.Hour)
+	for i, username := range []string{"alice", "bob"} {
+		voter := Voter{Username: username, CreatedAt: start.Add(time.Duration(i) * time.Minute)}
+		if err := s.db.Create(&voter).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := func(d time.Duration) gorm.Model {
+		return gorm.Model{CreatedAt: start.Add(d)}
+	}
+
+	s.db.AutoMigrate(&legacyVote{}, &legacyReferendumVote{})
+	for _, v := range []legacyVote{
+		{Tracker: "AAAA", Position: "Position 1", Candidate: `["Candidate 1"]`},
+		{Tracker: "AAAA", Position: "Position 2", Candidate: `["Candidate 3"]`},
+		{Model: at(-time.Minute), Position: "Position 1", Candidate: `["Candidate 2"]`},
+		{Model: at(time.Second), Position: "Position 1", Candidate: `["Candidate 1"]`},
+		{Model: at(2 * time.Second), Position: "Position 2", Candidate: `["Candidate 3"]`},
+		{Model: at(time.Minute + time.Second), Position: "Position 1", Candidate: `["Candidate 2"]`},
+		// bob can't have voted for Position 1 twice.
+		{Model: at(time.Minute + 2*time.Second), Position: "Position 1", Candidate: `["Candidate 1"]`},
+	} {
+		v := v
+		if err := s.db.Create(&v).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []legacyReferendumVote{
+		{Tracker: "AAAA", Question: "Q", Choice: "Yes"},
+		{Model: at(3 * time.Second), Question: "Q", Choice: "No"},
+	} {
+		a := a
+		if err := s.db.Create(&a).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runMigrate(s.db); err != nil {
+		t.Fatal(err)
+	}
+	if s.db.HasTable(&legacyVote{}) || s.db.HasTable(&legacyReferendumVote{}) {
+		t.Errorf("legacy tables not dropped")
+	}
+
+	ballots, err := loadBallots(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ballots) != 5 {
+		t.Fatalf("got %d ballots; wanted 5", len(ballots))
+	}
+	var grouped *Ballot
+	var untracked []*Ballot
+	for _, b := range ballots {
+		if b.Tracker == "AAAA" {
+			grouped = b
+		} else if b.Tracker != "" {
+			b.Tracker = ""
+			untracked = append(untracked, b)
+		}
+	}
+	if grouped == nil || len(untracked) != 4 {
+		t.Fatalf("got ballots %+v", ballots)
+	}
+	want := &Ballot{
+		Positions: map[string][]string{
+			"Position 1": {"Candidate 1"},
+			"Position 2": {"Candidate 3"},
+		},
+		Referendums: map[string]string{"Q": "Yes"},
+		Tracker:     "AAAA",
+	}
+	if !reflect.DeepEqual(grouped, want) {
+		t.Errorf("got %+v; wanted %+v", grouped, want)
+	}
+	ballot := func(position, candidate string) *Ballot {
+		return &Ballot{
+			Positions:   map[string][]string{position: {candidate}},
+			Referendums: map[string]string{},
+		}
+	}
+	alice := &Ballot{
+		Positions: map[string][]string{
+			"Position 1": {"Candidate 1"},
+			"Position 2": {"Candidate 3"},
+		},
+		Referendums: map[string]string{"Q": "No"},
+	}
+	for _, want := range []*Ballot{
+		alice,
+		ballot("Position 1", "Candidate 2"), // before any voter
+		ballot("Position 1", "Candidate 2"), // bob
+		ballot("Position 1", "Candidate 1"), // bob's second vote
+	} {
+		found := false
+		for i, b := range untracked {
+			if b != nil && reflect.DeepEqual(b, want) {
+				untracked[i] = nil
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing ballot %+v", want)
+		}
+	}
+
+	// Migrating again is a no-op.
+	if err := runMigrate(s.db); err != nil {
+		t.Fatal(err)
+	}
+	if ballots, _ := loadBallots(s.db); len(ballots) != 5 {
+		t.Errorf("got %d ballots after second migration", len(ballots))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// trackerBytes is the amount of randomness in a tracker code.
+const trackerBytes = 10
+
+// newTracker returns a random code identifying a ballot, such as
+// ABCD-EFGH-IJKL-MNOP. It is only shown to the voter on their receipt.
+func newTracker() (string, error) {
+	b := make([]byte, trackerBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.EncodeToString(b)
+	var groups []string
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// BulletinEntry is a ballot as published on the bulletin board.
+type BulletinEntry struct {
+	BallotHash string  `json:"ballot_hash"`
+	Ballot     *Ballot `json:"ballot"`
+}
+
+// Bulletin is the public list of every ballot cast.
+type Bulletin struct {
+	ElectionID string          `json:"election_id"`
+	Ballots    []BulletinEntry `json:"ballots"`
+	// Withdrawn lists the candidates who withdrew from each position,
+	// including from the admin console, since their ballots count towards
+	// the next choice.
+	Withdrawn map[string][]string `json:"withdrawn,omitempty"`
+}
+
+// loadBulletin builds the bulletin board from the stored ballots.
+func loadBulletin(db *gorm.DB) (*Bulletin, error) {
+	ballots, err := loadBallots(db)
+	if err != nil {
+		return nil, err
+	}
+	bulletin := &Bulletin{
+		ElectionID: c.ElectionID,
+		Ballots:    []BulletinEntry{},
+	}
+	for _, p := range c.Positions {
+		if len(p.Withdrawn) > 0 {
+			if bulletin.Withdrawn == nil {
+				bulletin.Withdrawn = map[string][]string{}
+			}
+			bulletin.Withdrawn[p.Name] = p.Withdrawn
+		}
+	}
+	for _, b := range ballots {
+		hash, err := hashBallot(b)
+		if err != nil {
+			return nil, err
+		}
+		bulletin.Ballots = append(bulletin.Ballots, BulletinEntry{
+			BallotHash: hash,
+			Ballot:     b,
+		})
+	}
+	return bulletin, nil
+}
+
+// handleBulletinJSON serves the bulletin board as JSON once voting ends.
+func (s *server) handleBulletinJSON(w http.ResponseWriter, r *http.Request) {
+	if ended, err := votingEnded(s.db); err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to load ballots", http.StatusInternalServerError)
+		return
+	} else if !ended {
+		http.Error(w, "the bulletin board is published when voting closes", http.StatusForbidden)
+		return
+	}
+	bulletin, err := loadBulletin(s.db)
+	if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to load ballots", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, bulletin)
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error: %+v", err)
+	}
+}
+
+// handleBulletin shows the bulletin board once voting ends.
+func (s *server) handleBulletin(w *TemplateWriter, r *http.Request) error {
+	w.Title("Bulletin Board")
+	if ended, err := votingEnded(s.db); err != nil {
+		return err
+	} else if !ended {
+		return errors.New("the bulletin board is published when voting closes")
+	}
+	bulletin, err := loadBulletin(s.db)
+	if err != nil {
+		return err
+	}
+	signed, _, err := loadCommitment(s.db)
+	if err != nil {
+		return err
+	}
+	var commitment Commitment
+	if err := json.Unmarshal(signed.Commitment, &commitment); err != nil {
+		return err
+	}
+	return s.tmpl.ExecuteTemplate(w, "bulletin.html", struct {
+		*Bulletin
+		Commitment Commitment
+	}{bulletin, commitment})
+}
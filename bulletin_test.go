@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var receiptRegexp = regexp.MustCompile(`(?s)<pre>\s*(.*?)\s*</pre>`)
+
+// castVote submits form and returns the receipt from the response.
+func castVote(t *testing.T, s *server, form map[string][]string) *Receipt {
+	req := httptest.NewRequest("POST", "/vote", nil)
+	req.Form = form
+	addCSRF(t, req)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	match := receiptRegexp.FindStringSubmatch(resp.Body.String())
+	if match == nil {
+		t.Fatalf("missing receipt: %s", resp.Body.Bytes())
+	}
+	var signed SignedReceipt
+	if err := json.Unmarshal([]byte(html.UnescapeString(match[1])), &signed); err != nil {
+		t.Fatal(err)
+	}
+	var receipt Receipt
+	if err := json.Unmarshal(signed.Receipt, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	return &receipt
+}
+
+func TestTracker(t *testing.T) {
+	a, err := newTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[A-Z2-7]{4}(-[A-Z2-7]{4}){3}$`).MatchString(a) || a == b {
+		t.Fatalf("bad tracker codes %q, %q", a, b)
+	}
+}
+
+func TestBulletin(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	receipt := castVote(t, s, goodForm())
+	if receipt.Ballot.Tracker == "" {
+		t.Fatalf("receipt missing tracker")
+	}
+
+	// Not published while voting is open.
+	for _, path := range []string{"/bulletin", "/bulletin.json"} {
+		req := httptest.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code == http.StatusOK {
+			t.Fatalf("%s: expected error while voting is open", path)
+		}
+	}
+
+	c.Open = false
+	c.Positions[4].Withdrawn = []string{"Candidate 7"}
+
+	req := httptest.NewRequest("GET", "/bulletin.json", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	var bulletin Bulletin
+	if err := json.Unmarshal(resp.Body.Bytes(), &bulletin); err != nil {
+		t.Fatal(err)
+	}
+	if len(bulletin.Ballots) != 1 {
+		t.Fatalf("got %d ballots; wanted 1", len(bulletin.Ballots))
+	}
+	entry := bulletin.Ballots[0]
+	if entry.Ballot.Tracker != receipt.Ballot.Tracker || entry.BallotHash != receipt.BallotHash {
+		t.Errorf("bulletin entry %+v does not match receipt %+v", entry, receipt)
+	}
+	if want := map[string][]string{"Position 5": {"Candidate 7"}}; !reflect.DeepEqual(bulletin.Withdrawn, want) {
+		t.Errorf("withdrawn = %v; wanted %v", bulletin.Withdrawn, want)
+	}
+
+	req = httptest.NewRequest("GET", "/bulletin", nil)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), receipt.Ballot.Tracker) {
+		t.Fatalf("bulletin page missing tracker: %s", resp.Body.Bytes())
+	}
+	if !strings.Contains(resp.Body.String(), "Candidate 7 (Position 5)") {
+		t.Errorf("bulletin page missing withdrawal: %s", resp.Body.Bytes())
+	}
+}
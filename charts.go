@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Chart dimensions, in SVG user units. templates/results.html places labels
+// using the same dimensions.
+const (
+	chartWidth      = 640
+	chartLabelWidth = 190
+	chartValueWidth = 110
+	chartBarHeight  = 24
+	sankeyFlowGap   = 6
+	sankeyNodeWidth = 12
+)
+
+// Chart colours.
+const (
+	colorContinuing = "#4a7ab5"
+	colorElected    = "#2e8b57"
+	colorExcluded   = "#c0504d"
+	colorExhausted  = "#999999"
+)
+
+// Bar is a single bar of a chart.
+type Bar struct {
+	Label   string
+	Votes   float64
+	Percent float64
+	Color   string
+	Y       float64
+	Width   float64
+}
+
+// RoundChart is a bar chart of the tallies at the start of a round.
+type RoundChart struct {
+	Number    int
+	Bars      []Bar
+	Exhausted float64
+	// Quota is the quota in the round, and QuotaX is the position of its
+	// line. Both are zero if there isn't one.
+	Quota    float64
+	QuotaX   float64
+	Height   float64
+	Elected  []string
+	Excluded string
+	Transfer *Transfer
+	// Sankey shows where votes moved before the next round, if known.
+	Sankey *Sankey
+}
+
+// SankeyFlow is the votes moving from the source to one candidate.
+type SankeyFlow struct {
+	To     string
+	Votes  float64
+	Path   string
+	Y      float64
+	Height float64
+	Mid    float64
+	Color  string
+}
+
+// Sankey is a diagram of the votes moving from an excluded or elected
+// candidate to the others between two rounds.
+type Sankey struct {
+	From   string
+	Votes  float64
+	Height float64
+	Flows  []SankeyFlow
+	// The source is drawn as a node at SourceX and the flows end at nodes at
+	// TargetX.
+	SourceX      float64
+	SourceY      float64
+	SourceHeight float64
+	SourceMid    float64
+	SourceColor  string
+	TargetX      float64
+}
+
+// Turnout is the number of ballots cast out of the number of eligible voters.
+type Turnout struct {
+	Ballots int
+	// Eligible is zero if not known.
+	Eligible int
+}
+
+// Percent returns the turnout as a percentage, or zero if the number of
+// eligible voters isn't known.
+func (t Turnout) Percent() float64 {
+	if t.Eligible == 0 {
+		return 0
+	}
+	return 100 * float64(t.Ballots) / float64(t.Eligible)
+}
+
+// PositionChart is the charts for a position's results.
+type PositionChart struct {
+	PositionResults
+	Method  Method
+	Turnout Turnout
+	Rounds  []RoundChart
+	// Final is the share of the votes in the last round.
+	Final       []Bar
+	FinalHeight float64
+}
+
+// ResultsPage is the data for results.html.
+type ResultsPage struct {
+	ElectionID  string
+	Turnout     Turnout
+	Positions   []PositionChart
+	Referendums []ReferendumOutcome
+	Errors      []string
+
+	// The published results.html shows how many Problems there were counting
+	// ballots instead of the Errors, and the Merkle Root of the ballots.
+	Problems int
+	Root     string
+}
+
+// candidateColor returns the colour of a candidate's bar in a round.
+func candidateColor(round Round, candidate string, elected map[string]bool) string {
+	switch {
+	case elected[candidate]:
+		return colorElected
+	case round.Excluded == candidate:
+		return colorExcluded
+	}
+	return colorContinuing
+}
+
+// newRoundCharts lays out a bar chart for each round of a count.
+func newRoundCharts(res *Result) []RoundChart {
+	var charts []RoundChart
+	elected := map[string]bool{}
+	for i, round := range res.Rounds {
+		for _, c := range round.Elected {
+			elected[c] = true
+		}
+		chart := RoundChart{
+			Number:    i + 1,
+			Exhausted: round.Exhausted,
+			Quota:     round.Quota,
+			Elected:   round.Elected,
+			Excluded:  round.Excluded,
+			Transfer:  round.Transfer,
+		}
+		if chart.Quota == 0 {
+			chart.Quota = res.Quota
+		}
+
+		max := chart.Quota
+		total := round.Exhausted
+		for _, v := range round.Tallies {
+			max = math.Max(max, v)
+			total += v
+		}
+		max = math.Max(max, round.Exhausted)
+		scale := 0.0
+		if max > 0 {
+			scale = (chartWidth - chartLabelWidth - chartValueWidth) / max
+		}
+
+		addBar := func(label string, votes float64, color string) {
+			bar := Bar{
+				Label: label,
+				Votes: votes,
+				Color: color,
+				Y:     float64(len(chart.Bars) * chartBarHeight),
+				Width: votes * scale,
+			}
+			if total > 0 {
+				bar.Percent = 100 * votes / total
+			}
+			chart.Bars = append(chart.Bars, bar)
+		}
+		for _, c := range res.Candidates {
+			if v, ok := round.Tallies[c]; ok {
+				addBar(c, v, candidateColor(round, c, elected))
+			}
+		}
+		if round.Exhausted > 0 {
+			addBar("Exhausted", round.Exhausted, colorExhausted)
+		}
+		chart.Height = float64(len(chart.Bars) * chartBarHeight)
+		if chart.Quota > 0 {
+			chart.QuotaX = chartLabelWidth + chart.Quota*scale
+		}
+		if i+1 < len(res.Rounds) {
+			chart.Sankey = newSankey(res, round, res.Rounds[i+1])
+		}
+		charts = append(charts, chart)
+	}
+	return charts
+}
+
+// newSankey lays out the votes moving from the candidate excluded, or whose
+// surplus was transferred, in a round to the candidates in the next one. It
+// returns nil if votes didn't move from a single candidate, e.g. when
+// counting with Meek's method.
+func newSankey(res *Result, round, next Round) *Sankey {
+	from := round.Excluded
+	if round.Transfer != nil {
+		from = round.Transfer.From
+	}
+	if from == "" || round.Keep != nil {
+		return nil
+	}
+
+	sankey := &Sankey{From: from, SourceColor: colorExcluded}
+	if round.Transfer != nil {
+		sankey.SourceColor = colorElected
+	}
+	for _, c := range res.Candidates {
+		v, ok := next.Tallies[c]
+		if !ok || c == from {
+			continue
+		}
+		if delta := v - round.Tallies[c]; delta > tallyEpsilon {
+			sankey.Flows = append(sankey.Flows, SankeyFlow{To: c, Votes: delta, Color: colorContinuing})
+		}
+	}
+	if delta := next.Exhausted - round.Exhausted; delta > tallyEpsilon {
+		sankey.Flows = append(sankey.Flows, SankeyFlow{To: "Exhausted", Votes: delta, Color: colorExhausted})
+	}
+	if len(sankey.Flows) == 0 {
+		return nil
+	}
+
+	for _, f := range sankey.Flows {
+		sankey.Votes += f.Votes
+	}
+	// The diagram is as tall as a bar chart with a bar per flow. Each flow is
+	// at least two units high so that small transfers stay visible.
+	available := float64(len(sankey.Flows) * chartBarHeight)
+	sankey.Height = available + float64((len(sankey.Flows)-1)*sankeyFlowGap)
+	sourceTop := (sankey.Height - available) / 2
+	sankey.SourceX = chartLabelWidth
+	sankey.SourceY = sourceTop
+	sankey.TargetX = chartWidth - chartLabelWidth - sankeyNodeWidth
+	left := sankey.SourceX + sankeyNodeWidth
+	right := sankey.TargetX
+	mid := (left + right) / 2
+	y, sourceY := 0.0, sourceTop
+	for i := range sankey.Flows {
+		f := &sankey.Flows[i]
+		f.Height = math.Max(2, available*f.Votes/sankey.Votes)
+		f.Y = y
+		f.Mid = y + f.Height/2
+		f.Path = fmt.Sprintf("M%s,%s C%s,%s %s,%s %s,%s L%s,%s C%s,%s %s,%s %s,%s Z",
+			svgNum(left), svgNum(sourceY),
+			svgNum(mid), svgNum(sourceY), svgNum(mid), svgNum(y), svgNum(right), svgNum(y),
+			svgNum(right), svgNum(y+f.Height),
+			svgNum(mid), svgNum(y+f.Height), svgNum(mid), svgNum(sourceY+f.Height), svgNum(left), svgNum(sourceY+f.Height),
+		)
+		y += f.Height + sankeyFlowGap
+		sourceY += f.Height
+	}
+	sankey.SourceHeight = sourceY - sourceTop
+	sankey.SourceMid = sourceTop + sankey.SourceHeight/2
+	sankey.Height = math.Max(sankey.Height, y-sankeyFlowGap)
+	return sankey
+}
+
+// svgNum formats a coordinate or vote count to at most two decimal places.
+func svgNum(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// finalShares returns each candidate's share of the votes in the last round.
+func finalShares(res *Result) []Bar {
+	if len(res.Rounds) == 0 {
+		return nil
+	}
+	last := res.Rounds[len(res.Rounds)-1]
+	total := 0.0
+	for _, v := range last.Tallies {
+		total += v
+	}
+	winners := map[string]bool{}
+	for _, w := range res.Winners {
+		winners[w] = true
+	}
+	var bars []Bar
+	for _, c := range res.Candidates {
+		v, ok := last.Tallies[c]
+		if !ok {
+			continue
+		}
+		bar := Bar{Label: c, Votes: v, Color: colorContinuing}
+		if winners[c] {
+			bar.Color = colorElected
+		}
+		if total > 0 {
+			bar.Percent = 100 * v / total
+		}
+		bar.Y = float64(len(bars) * chartBarHeight)
+		bar.Width = bar.Percent / 100 * (chartWidth - chartLabelWidth - chartValueWidth)
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
+// newResultsPage lays out the charts for the results, with turnout against
+// the voter roll.
+func newResultsPage(db *gorm.DB, results *Results) (*ResultsPage, error) {
+	eligible, err := rollSize(db)
+	if err != nil {
+		return nil, err
+	}
+	var roll []RollEntry
+	if err := db.Find(&roll).Error; err != nil {
+		return nil, err
+	}
+
+	page := &ResultsPage{
+		ElectionID:  results.ElectionID,
+		Turnout:     Turnout{Ballots: results.Ballots, Eligible: eligible},
+		Referendums: results.Referendums,
+		Errors:      results.Errors,
+	}
+	for i, p := range results.Positions {
+		chart := PositionChart{
+			PositionResults: p,
+			Turnout:         Turnout{Ballots: p.Ballots, Eligible: eligible},
+		}
+		if position := c.Positions[i]; position.Eligible.Restricted() {
+			chart.Turnout.Eligible = 0
+			for _, entry := range roll {
+				entry := entry
+				if position.Eligible.Allows(&entry) {
+					chart.Turnout.Eligible++
+				}
+			}
+		}
+		if p.Result != nil {
+			chart.Method = methods[p.Result.Method]
+			chart.Rounds = newRoundCharts(p.Result)
+			chart.Final = finalShares(p.Result)
+			chart.FinalHeight = float64(len(chart.Final) * chartBarHeight)
+		}
+		page.Positions = append(page.Positions, chart)
+	}
+	return page, nil
+}
+
+// handleResultsPage shows the results with charts.
+func (s *server) handleResultsPage(w *TemplateWriter, r *http.Request) error {
+	w.Title("Results")
+
+	user, err := adminUser(r)
+	if err != nil {
+		return err
+	}
+	audit(AuditResultsViewed, map[string]string{"user": user, "export": r.URL.Path})
+
+	ballots, err := loadBallots(s.db)
+	if err != nil {
+		return err
+	}
+	results, err := tallyBallots(ballots)
+	if err != nil {
+		return err
+	}
+	page, err := newResultsPage(s.db, results)
+	if err != nil {
+		return err
+	}
+	return s.tmpl.ExecuteTemplate(w, "results.html", page)
+}
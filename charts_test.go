@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoundCharts(t *testing.T) {
+	res := &Result{
+		Candidates: []string{"A", "B", "C"},
+		Winners:    []string{"A"},
+		Rounds: []Round{
+			{Tallies: map[string]float64{"A": 4, "B": 3, "C": 3}, Excluded: "C"},
+			{Tallies: map[string]float64{"A": 6, "B": 3}, Exhausted: 1, Elected: []string{"A"}},
+		},
+	}
+	charts := newRoundCharts(res)
+	if len(charts) != 2 {
+		t.Fatalf("got %d rounds", len(charts))
+	}
+	first := charts[0]
+	if len(first.Bars) != 3 || first.Bars[2].Color != colorExcluded || first.Bars[0].Width != chartWidth-chartLabelWidth-chartValueWidth {
+		t.Errorf("unexpected first round bars: %+v", first.Bars)
+	}
+	if first.Bars[0].Percent != 40 {
+		t.Errorf("got %v%%; wanted 40%%", first.Bars[0].Percent)
+	}
+	if last := charts[1]; len(last.Bars) != 3 || last.Bars[0].Color != colorElected || last.Bars[2].Label != "Exhausted" || last.Sankey != nil {
+		t.Errorf("unexpected last round: %+v", last)
+	}
+
+	sankey := first.Sankey
+	if sankey == nil {
+		t.Fatalf("expected transfers from C")
+	}
+	if sankey.From != "C" || sankey.Votes != 3 || len(sankey.Flows) != 2 {
+		t.Fatalf("unexpected transfers: %+v", sankey)
+	}
+	if f := sankey.Flows[0]; f.To != "A" || f.Votes != 2 || f.Height != 2*sankey.Flows[1].Height {
+		t.Errorf("unexpected flow: %+v", f)
+	}
+	if f := sankey.Flows[1]; f.To != "Exhausted" || f.Votes != 1 {
+		t.Errorf("unexpected flow: %+v", f)
+	}
+	if sankey.SourceHeight != sankey.Flows[0].Height+sankey.Flows[1].Height {
+		t.Errorf("source is %v high; wanted the sum of the flows", sankey.SourceHeight)
+	}
+
+	final := finalShares(res)
+	if len(final) != 2 || final[0].Label != "A" || final[0].Percent != 200.0/3 || final[0].Color != colorElected {
+		t.Errorf("unexpected final shares: %+v", final)
+	}
+}
+
+func TestResultsPage(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	castVote(t, s, goodForm())
+	c.Admins = []string{"test"}
+
+	req := httptest.NewRequest("GET", "/admin/results", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	body := resp.Body.String()
+	for _, want := range []string{
+		"1 ballots were cast in election <code>test</code>\nby 2 eligible voters, a turnout of\n50.0%",
+		`<h2 id="position-1">Position 1</h2>`,
+		"Winner: Candidate 2",
+		"instant-runoff voting",
+		"<svg",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("results page missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// command is a subcommand of the elections binary, run as
+// `elections.cgi <name> [args]`.
+type command struct {
+	desc string
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"audit": {
+		desc: "verify the hash chain and signatures of the audit log",
+		run:  runAudit,
+	},
+	"hash-roll": {
+		desc: "hash the identifiers in a voter roll for import-roll -hashed",
+		run:  runHashRoll,
+	},
+	"import-roll": {
+		desc: "replace the voter roll with a CSV or JSON file",
+		run:  runImportRoll,
+	},
+	"issue-tokens": {
+		desc: "issue one-time voting tokens to voters on the roll",
+		run:  runIssueTokens,
+	},
+	"send-invitations": {
+		desc: "email invitations to vote to voters on the roll",
+		run:  runSendInvitations,
+	},
+	"send-mail": {
+		desc: "send queued invitations and vote confirmations",
+		run:  runSendMail,
+	},
+	"tally": {
+		desc: "count the ballots in a database or bulletin board export",
+		run:  runTally,
+	},
+	"verify-receipt": {
+		desc: "verify the signature on a voting receipt",
+		run:  runVerifyReceipt,
+	},
+}
+
+// runCommand runs the subcommand named by the first argument.
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\t%s\n", name, commands[name].desc)
+		}
+		return errors.Errorf("unknown command %q", args[0])
+	}
+	return cmd.run(args[1:])
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// pairwise returns the number of ballots ranking each candidate above each
+// other candidate. Ranked candidates are preferred to unranked ones.
+func pairwise(candidates []string, ballots [][]string) map[string]map[string]int {
+	d := map[string]map[string]int{}
+	for _, c := range candidates {
+		d[c] = map[string]int{}
+	}
+	for _, ballot := range ballots {
+		rank := map[string]int{}
+		for i, c := range ballot {
+			rank[c] = i
+		}
+		for _, a := range candidates {
+			ra, ok := rank[a]
+			if !ok {
+				continue
+			}
+			for _, b := range candidates {
+				if rb, ok := rank[b]; a != b && (!ok || ra < rb) {
+					d[a][b]++
+				}
+			}
+		}
+	}
+	return d
+}
+
+// condorcetPoll is the shared state of the Condorcet methods.
+type condorcetPoll struct {
+	ballotBox
+	method string
+	seats  int
+}
+
+func newCondorcetPoll(method string, candidates []string, seats int) (condorcetPoll, error) {
+	if seats < 1 {
+		return condorcetPoll{}, errors.Errorf("%s: invalid number of seats %d", method, seats)
+	}
+	box, err := newBallotBox(candidates)
+	if err != nil {
+		return condorcetPoll{}, errors.Wrap(err, method)
+	}
+	return condorcetPoll{
+		ballotBox: box,
+		method:    method,
+		seats:     seats,
+	}, nil
+}
+
+// result elects the candidates that beat the most other candidates according
+// to beats.
+func (p *condorcetPoll) result(d map[string]map[string]int, beats func(a, b string) bool, notes []string) (*Result, error) {
+	round := Round{
+		Tallies: map[string]float64{},
+		Notes:   notes,
+	}
+	for _, a := range p.candidates {
+		round.Tallies[a] = 0
+		for _, b := range p.candidates {
+			if a != b && beats(a, b) {
+				round.Tallies[a]++
+			}
+		}
+	}
+	tb := p.newTieBreaker()
+	var err error
+	round.Elected, round.Tied, round.TieBreak, err = tb.topN(p.candidates, round.Tallies, p.seats, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Method:     p.method,
+		Candidates: p.candidates,
+		Seats:      p.seats,
+		Winners:    round.Elected,
+		Rounds:     []Round{round},
+		Pairwise:   d,
+	}
+	tb.describe(res)
+	return res, nil
+}
+
+// SchulzePoll counts ranked ballots using the Schulze beatpath method. The
+// round tallies are the number of candidates each candidate beats.
+type SchulzePoll struct {
+	condorcetPoll
+}
+
+// NewSchulzePoll creates a Schulze poll filling seats from candidates.
+func NewSchulzePoll(candidates []string, seats int) (*SchulzePoll, error) {
+	poll, err := newCondorcetPoll(MethodSchulze, candidates, seats)
+	if err != nil {
+		return nil, err
+	}
+	return &SchulzePoll{poll}, nil
+}
+
+// Evaluate computes the strongest paths between every pair of candidates.
+func (p *SchulzePoll) Evaluate() (*Result, error) {
+	if len(p.ballots) == 0 {
+		return nil, errors.New("schulze: no ballots")
+	}
+	d := pairwise(p.candidates, p.ballots)
+	strength := map[string]map[string]int{}
+	for _, a := range p.candidates {
+		strength[a] = map[string]int{}
+		for _, b := range p.candidates {
+			if a != b && d[a][b] > d[b][a] {
+				strength[a][b] = d[a][b]
+			}
+		}
+	}
+	for _, i := range p.candidates {
+		for _, j := range p.candidates {
+			if i == j {
+				continue
+			}
+			for _, k := range p.candidates {
+				if k == i || k == j {
+					continue
+				}
+				via := strength[j][i]
+				if strength[i][k] < via {
+					via = strength[i][k]
+				}
+				if via > strength[j][k] {
+					strength[j][k] = via
+				}
+			}
+		}
+	}
+	return p.result(d, func(a, b string) bool {
+		return strength[a][b] > strength[b][a]
+	}, nil)
+}
+
+// RankedPairsPoll counts ranked ballots using Tideman's ranked pairs. The
+// round tallies are the number of candidates each candidate is locked above.
+type RankedPairsPoll struct {
+	condorcetPoll
+}
+
+// NewRankedPairsPoll creates a ranked pairs poll filling seats from
+// candidates.
+func NewRankedPairsPoll(candidates []string, seats int) (*RankedPairsPoll, error) {
+	poll, err := newCondorcetPoll(MethodRankedPairs, candidates, seats)
+	if err != nil {
+		return nil, err
+	}
+	return &RankedPairsPoll{poll}, nil
+}
+
+// Evaluate locks in pairwise victories from strongest to weakest, skipping any
+// that would create a cycle.
+func (p *RankedPairsPoll) Evaluate() (*Result, error) {
+	if len(p.ballots) == 0 {
+		return nil, errors.New("rankedpairs: no ballots")
+	}
+	d := pairwise(p.candidates, p.ballots)
+
+	type pair struct {
+		winner, loser string
+	}
+	var pairs []pair
+	for _, a := range p.candidates {
+		for _, b := range p.candidates {
+			if d[a][b] > d[b][a] {
+				pairs = append(pairs, pair{a, b})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		a, b := pairs[i], pairs[j]
+		if d[a.winner][a.loser] != d[b.winner][b.loser] {
+			return d[a.winner][a.loser] > d[b.winner][b.loser]
+		}
+		return d[a.loser][a.winner] < d[b.loser][b.winner]
+	})
+
+	locked := map[string]map[string]bool{}
+	for _, c := range p.candidates {
+		locked[c] = map[string]bool{}
+	}
+	var reaches func(from, to string, seen map[string]bool) bool
+	reaches = func(from, to string, seen map[string]bool) bool {
+		if from == to {
+			return true
+		}
+		seen[from] = true
+		for next := range locked[from] {
+			if !seen[next] && reaches(next, to, seen) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var notes []string
+	for _, pr := range pairs {
+		margin := fmt.Sprintf("%d to %d", d[pr.winner][pr.loser], d[pr.loser][pr.winner])
+		if reaches(pr.loser, pr.winner, map[string]bool{}) {
+			notes = append(notes, fmt.Sprintf("Skipped %s > %s (%s): creates a cycle", pr.winner, pr.loser, margin))
+			continue
+		}
+		locked[pr.winner][pr.loser] = true
+		notes = append(notes, fmt.Sprintf("Locked %s > %s (%s)", pr.winner, pr.loser, margin))
+	}
+
+	return p.result(d, func(a, b string) bool {
+		return reaches(a, b, map[string]bool{})
+	}, notes)
+}
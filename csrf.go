@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Vote form fields and cookies.
+const (
+	csrfCookie = "elections_csrf"
+	csrfField  = "csrf_token"
+	// idempotencyField identifies a submission of the ballot form, so that
+	// submitting it twice returns the first receipt.
+	idempotencyField = "idempotency_key"
+)
+
+// errCSRF is returned for votes and console changes without a valid CSRF
+// token.
+var errCSRF = errors.New("Your session expired or the form was submitted from another site. Please reload the page and try again.")
+
+// Submission is the receipt for a submission of the ballot form, encrypted
+// with its idempotency key. Only a hash of the key is stored, so receipts,
+// which show how someone voted, can't be read without it.
+type Submission struct {
+	KeyHash string `gorm:"primary_key"`
+	Receipt []byte
+}
+
+// TableName implements gorm.tabler.
+func (Submission) TableName() string {
+	return "submissions"
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// csrfKey returns the key CSRF tokens are signed with, derived from the
+// receipt signing key so no other secret needs to be configured.
+func csrfKey() ([]byte, error) {
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, x509.MarshalPKCS1PrivateKey(key))
+	mac.Write([]byte("csrf"))
+	return mac.Sum(nil), nil
+}
+
+// csrfIdentity returns who a CSRF token is issued to: the logged in user, or
+// the voting token.
+func csrfIdentity(r *http.Request) string {
+	if token := votingToken(r); token != nil {
+		return "token:" + token.Hash
+	}
+	return "user:" + remoteUser(r)
+}
+
+// csrfToken returns the CSRF token for a session and identity.
+func csrfToken(session, identity string) (string, error) {
+	key, err := csrfKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(session + "\x00" + identity))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// csrfSession returns the CSRF token for the ballot and console forms,
+// starting a session in a cookie if there isn't one. The cookie is only sent
+// with requests from the elections site, and the token is tied to it and to
+// the user, so another site can't submit a form for them.
+func csrfSession(w http.ResponseWriter, r *http.Request) (string, error) {
+	var session string
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 32 {
+		session = cookie.Value
+	} else {
+		var err error
+		if session, err = randomHex(16); err != nil {
+			return "", err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    session,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return csrfToken(session, csrfIdentity(r))
+}
+
+// checkCSRF returns errCSRF unless r has the CSRF token for its session.
+func checkCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return errCSRF
+	}
+	want, err := csrfToken(cookie.Value, csrfIdentity(r))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(r.FormValue(csrfField)), []byte(want)) {
+		return errCSRF
+	}
+	return nil
+}
+
+// submissionKeys derives the stored hash of an idempotency key and the key
+// its receipt is encrypted with. Both depend on the voter's csrfIdentity too,
+// so a receipt can only be loaded by the voter who submitted it.
+func submissionKeys(key, identity string) (string, []byte) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(label + "\x00" + identity))
+		return mac.Sum(nil)
+	}
+	return hex.EncodeToString(derive("id")), derive("receipt")
+}
+
+// sealCipher returns the cipher seal and unseal use with a 32 byte secret.
+func sealCipher(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with AES-GCM, prefixing it with a random nonce.
+func seal(secret, plaintext []byte) ([]byte, error) {
+	gcm, err := sealCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal decrypts what seal returned.
+func unseal(secret, sealed []byte) ([]byte, error) {
+	gcm, err := sealCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("truncated")
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+// storeSubmission stores the receipt for a submission. It must be called in
+// the transaction that stores the ballot.
+func storeSubmission(tx *gorm.DB, key, identity string, receipt []byte) error {
+	hash, secret := submissionKeys(key, identity)
+	sealed, err := seal(secret, receipt)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&Submission{KeyHash: hash, Receipt: sealed}).Error
+}
+
+// loadSubmission returns the ballot and receipt of an earlier submission
+// by identity with the same idempotency key, or nil if there wasn't one.
+func loadSubmission(db *gorm.DB, key, identity string) (*Ballot, []byte, error) {
+	if key == "" {
+		return nil, nil, nil
+	}
+	hash, secret := submissionKeys(key, identity)
+	var submission Submission
+	if err := db.Where("key_hash = ?", hash).First(&submission).Error; gorm.IsRecordNotFoundError(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	body, err := unseal(secret, submission.Receipt)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "decrypting stored receipt")
+	}
+
+	var signed SignedReceipt
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, nil, err
+	}
+	var receipt Receipt
+	if err := json.Unmarshal(signed.Receipt, &receipt); err != nil {
+		return nil, nil, err
+	}
+	return receipt.Ballot, body, nil
+}
+
+// submitVote checks the CSRF token of a vote and accepts it, returning the
+// ballot and signed receipt. If the form was already submitted, e.g. by
+// double clicking, the first receipt is returned and resubmitted is set. This
+// is the only thing a used voting token can do.
+func (s *server) submitVote(r *http.Request) (ballot *Ballot, receipt []byte, resubmitted bool, err error) {
+	if r.Method != http.MethodPost {
+		return nil, nil, false, errors.New("must use post")
+	}
+	if err := checkCSRF(r); err != nil {
+		return nil, nil, false, err
+	}
+	key, identity := r.FormValue(idempotencyField), csrfIdentity(r)
+	if ballot, receipt, err := loadSubmission(s.db, key, identity); err != nil || ballot != nil {
+		return ballot, receipt, true, err
+	}
+	if token := votingToken(r); token != nil && token.Used {
+		return nil, nil, false, errTokenUsed
+	}
+	ballot, receipt, err = s.acceptVote(r)
+	if err != nil {
+		// A second submission can race the first and be rejected as a
+		// duplicate vote, in which case the first has been stored.
+		if first, firstReceipt, loadErr := loadSubmission(s.db, key, identity); loadErr == nil && first != nil {
+			return first, firstReceipt, true, nil
+		}
+		return nil, nil, false, err
+	}
+	return ballot, receipt, false, nil
+}
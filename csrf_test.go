@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testCSRFSession is the CSRF session of requests in tests.
+const testCSRFSession = "0123456789abcdef0123456789abcdef"
+
+// addCSRF adds the CSRF cookie and token that the ballot form would have to
+// a vote.
+func addCSRF(t *testing.T, req *http.Request) {
+	identity := "user:" + os.Getenv("REMOTE_USER")
+	if token := req.Form.Get("token"); token != "" {
+		identity = "token:" + hashToken(token)
+	}
+	token, err := csrfToken(testCSRFSession, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFSession})
+	req.Form.Set(csrfField, token)
+}
+
+var formFieldRegexp = regexp.MustCompile(`name="(csrf_token|idempotency_key)" value="([^"]*)"`)
+
+func TestCSRF(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	// Loading the ballot starts a session.
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Result().Cookies() {
+		if c.Name == csrfCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("expected a strict session cookie; got %+v", cookie)
+	}
+	fields := map[string]string{}
+	for _, match := range formFieldRegexp.FindAllStringSubmatch(resp.Body.String(), -1) {
+		fields[match[1]] = match[2]
+	}
+	if fields[csrfField] == "" || len(fields[idempotencyField]) != 32 {
+		t.Fatalf("expected ballot to contain the CSRF token and an idempotency key; got %v", fields)
+	}
+
+	vote := func(form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = form
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+	for _, tc := range []struct {
+		name   string
+		token  string
+		cookie *http.Cookie
+	}{
+		{"missing token", "", cookie},
+		{"missing cookie", fields[csrfField], nil},
+		{"another session", fields[csrfField], &http.Cookie{Name: csrfCookie, Value: testCSRFSession}},
+	} {
+		form := goodForm()
+		form.Set(csrfField, tc.token)
+		if resp := vote(form, tc.cookie); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "submitted from another site") {
+			t.Errorf("%s: expected vote to be rejected; got %d", tc.name, resp.Code)
+		}
+	}
+
+	// Another user's token isn't valid for the session.
+	os.Setenv("REMOTE_USER", "other")
+	form := goodForm()
+	form.Set(csrfField, fields[csrfField])
+	resp = vote(form, cookie)
+	os.Setenv("REMOTE_USER", "test")
+	if !strings.Contains(resp.Body.String(), "submitted from another site") {
+		t.Errorf("expected another user's vote to be rejected; got %d", resp.Code)
+	}
+
+	// Double submits return the first receipt.
+	form = goodForm()
+	form.Set(csrfField, fields[csrfField])
+	form.Set(idempotencyField, fields[idempotencyField])
+	first := vote(form, cookie)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", first.Body.Bytes())
+	}
+	second := vote(form, cookie)
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("expected resubmission to return the first receipt; got %s", second.Body.Bytes())
+	}
+	count := 0
+	if err := s.db.Model(&BallotRecord{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 ballot; got %d", count)
+	}
+
+	// A new submission is still rejected.
+	form.Set(idempotencyField, "fedcba9876543210fedcba9876543210")
+	if resp := vote(form, cookie); !strings.Contains(resp.Body.String(), "already voted") {
+		t.Errorf("expected another submission to be rejected; got %s", resp.Body.Bytes())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Eligibility restricts who may vote for a position using their entry on the
+// voter roll. Each list that is set must include the voter's value, e.g.
+// years: [1] for a first year representative.
+type Eligibility struct {
+	Classes  []string
+	Programs []string
+	Years    []int
+}
+
+// Restricted reports whether any rules are set.
+func (e Eligibility) Restricted() bool {
+	return len(e.Classes) > 0 || len(e.Programs) > 0 || len(e.Years) > 0
+}
+
+// Allows reports whether the voter with the given roll entry may vote. Only
+// unrestricted positions are open to voters who aren't on an imported roll.
+func (e Eligibility) Allows(entry *RollEntry) bool {
+	if !e.Restricted() {
+		return true
+	}
+	if entry == nil {
+		return false
+	}
+	if len(e.Classes) > 0 && !containsFold(e.Classes, entry.Class) {
+		return false
+	}
+	if len(e.Programs) > 0 && !containsFold(e.Programs, entry.Program) {
+		return false
+	}
+	if len(e.Years) > 0 {
+		found := false
+		for _, year := range e.Years {
+			found = found || year == entry.Year
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the rules for voters.
+func (e Eligibility) String() string {
+	var parts []string
+	if len(e.Classes) > 0 {
+		parts = append(parts, "class "+strings.Join(e.Classes, " or "))
+	}
+	if len(e.Programs) > 0 {
+		parts = append(parts, "program "+strings.Join(e.Programs, " or "))
+	}
+	if len(e.Years) > 0 {
+		var years []string
+		for _, year := range e.Years {
+			years = append(years, fmt.Sprint(year))
+		}
+		parts = append(parts, "year "+strings.Join(years, " or "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), strings.TrimSpace(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// eligiblePositions returns the positions the voter with the given roll entry
+// may vote for.
+func eligiblePositions(entry *RollEntry) []Position {
+	var positions []Position
+	for _, p := range c.Positions {
+		if p.Eligible.Allows(entry) {
+			positions = append(positions, p)
+		}
+	}
+	return positions
+}
+
+// hasPositionFields reports whether the form includes any answer for the
+// position.
+func hasPositionFields(r *http.Request, p Position) bool {
+	if r.FormValue(p.Name) != "" {
+		return true
+	}
+	for _, candidate := range p.Candidates {
+		if r.FormValue(slugify(p.Name+"-"+candidate)) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEligibilityAllows(t *testing.T) {
+	entry := &RollEntry{Program: "BCS", Year: 1, Class: "member"}
+	for _, tc := range []struct {
+		e     Eligibility
+		entry *RollEntry
+		want  bool
+	}{
+		{Eligibility{}, nil, true},
+		{Eligibility{Years: []int{1}}, nil, false},
+		{Eligibility{Years: []int{1}}, entry, true},
+		{Eligibility{Years: []int{2, 3}}, entry, false},
+		{Eligibility{Programs: []string{"bcs", "BSc"}, Classes: []string{"Member"}}, entry, true},
+		{Eligibility{Programs: []string{"BCS"}, Classes: []string{"associate"}}, entry, false},
+	} {
+		if got := tc.e.Allows(tc.entry); got != tc.want {
+			t.Errorf("%+v.Allows(%+v) = %v; wanted %v", tc.e, tc.entry, got, tc.want)
+		}
+	}
+	if got := (Eligibility{Programs: []string{"BCS"}, Years: []int{1, 2}}).String(); got != "program BCS, year 1 or 2" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestVoteEligibility(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	c.Positions[6].Eligible = Eligibility{Years: []int{1}}
+	c.Positions[5].Name = "First Year Rep"
+	c.Positions[5].Eligible = Eligibility{Years: []int{1}}
+	if err := importRoll(s.db, []RollEntry{
+		{StudentNumber: "12345678", Username: "test", Year: 3},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if body := resp.Body.String(); strings.Contains(body, "First Year Rep") || !strings.Contains(body, "Position 5") {
+		t.Fatalf("expected only eligible positions; got %s", body)
+	}
+
+	vote := func(form func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		form(req)
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+	// goodForm votes for Position 7, which this voter isn't eligible for.
+	if resp := vote(func(*http.Request) {}); resp.Code != http.StatusInternalServerError || !strings.Contains(html.UnescapeString(resp.Body.String()), `eligible to vote for "Position 7"`) {
+		t.Fatalf("expected ineligible error; got %s", resp.Body.Bytes())
+	}
+	if resp := vote(func(r *http.Request) { r.Form.Del("Position 7") }); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+
+	ballots, err := loadBallots(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ballots) != 1 {
+		t.Fatalf("expected 1 ballot; got %d", len(ballots))
+	}
+	if _, ok := ballots[0].Positions["Position 7"]; ok {
+		t.Errorf("ballot includes ineligible position: %+v", ballots[0].Positions)
+	}
+}
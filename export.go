@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// bltName quotes a name for a ballot file. The format has no escapes, so
+// double quotes are replaced.
+func bltName(name string) string {
+	return `"` + strings.Replace(name, `"`, "'", -1) + `"`
+}
+
+// writeBLT writes the ballots for a position in the ballot file format used
+// by OpenSTV and the Electoral Reform Society, so they can be recounted with
+// other software. Withdrawn candidates are listed as such rather than removed
+// from the ballots.
+func writeBLT(w io.Writer, p Position, ballots []*Ballot) error {
+	candidates := append(append([]string(nil), p.Candidates...), "Reopen Nominations")
+	index := map[string]int{}
+	for i, candidate := range candidates {
+		index[candidate] = i + 1
+	}
+
+	fmt.Fprintf(w, "%d %d\n", len(candidates), p.NumSeats())
+	if len(p.Withdrawn) > 0 {
+		var withdrawn []string
+		for _, candidate := range p.Withdrawn {
+			withdrawn = append(withdrawn, strconv.Itoa(-index[candidate]))
+		}
+		fmt.Fprintln(w, strings.Join(withdrawn, " "))
+	}
+	for _, b := range ballots {
+		ranking, ok := b.Positions[p.Name]
+		if !ok {
+			continue
+		}
+		line := []string{"1"}
+		for _, candidate := range ranking {
+			i, ok := index[candidate]
+			if !ok {
+				return errors.Errorf("unknown candidate %q on ballot %s", candidate, b.Tracker)
+			}
+			line = append(line, strconv.Itoa(i))
+		}
+		fmt.Fprintln(w, strings.Join(append(line, "0"), " "))
+	}
+	fmt.Fprintln(w, "0")
+	for _, candidate := range candidates {
+		fmt.Fprintln(w, bltName(candidate))
+	}
+	_, err := fmt.Fprintln(w, bltName(p.Name))
+	return err
+}
+
+// formatVotes formats a vote count for export without losing precision.
+func formatVotes(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// writeRoundsCSV writes the counts for each round of a position, one row per
+// round.
+func writeRoundsCSV(w io.Writer, res *Result) error {
+	cw := csv.NewWriter(w)
+	header := append([]string{"round"}, res.Candidates...)
+	header = append(header, "exhausted", "quota", "elected", "excluded", "transferred")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for i, round := range res.Rounds {
+		row := []string{strconv.Itoa(i + 1)}
+		for _, candidate := range res.Candidates {
+			if v, ok := round.Tallies[candidate]; ok {
+				row = append(row, formatVotes(v))
+			} else {
+				row = append(row, "")
+			}
+		}
+		quota := round.Quota
+		if quota == 0 {
+			quota = res.Quota
+		}
+		var quotaText, transferred string
+		if quota > 0 {
+			quotaText = formatVotes(quota)
+		}
+		if round.Transfer != nil {
+			transferred = round.Transfer.From
+		}
+		row = append(row,
+			formatVotes(round.Exhausted),
+			quotaText,
+			strings.Join(round.Elected, ";"),
+			round.Excluded,
+			transferred,
+		)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportPosition returns the position named in the request's position
+// parameter.
+func exportPosition(r *http.Request) (Position, bool) {
+	name := r.URL.Query().Get("position")
+	for _, p := range c.Positions {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Position{}, false
+}
+
+// handleExport checks that the user is an admin and loads and counts the
+// ballots for an export.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request, f func(ballots []*Ballot, results *Results) error) {
+	user, err := adminUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	audit(AuditResultsViewed, map[string]string{"user": user, "export": r.URL.Path})
+
+	ballots, err := loadBallots(s.db)
+	if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to load ballots", http.StatusInternalServerError)
+		return
+	}
+	results, err := tallyBallots(ballots)
+	if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to count ballots", http.StatusInternalServerError)
+		return
+	}
+	if err := f(ballots, results); err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleResultsJSON serves the results of every position and referendum.
+func (s *server) handleResultsJSON(w http.ResponseWriter, r *http.Request) {
+	s.handleExport(w, r, func(ballots []*Ballot, results *Results) error {
+		writeJSON(w, results)
+		return nil
+	})
+}
+
+// handleResultsCSV serves the round by round counts of a position.
+func (s *server) handleResultsCSV(w http.ResponseWriter, r *http.Request) {
+	p, ok := exportPosition(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.handleExport(w, r, func(ballots []*Ballot, results *Results) error {
+		for _, res := range results.Positions {
+			if res.Position != p.Name {
+				continue
+			}
+			if res.Error != "" {
+				return errors.New(res.Error)
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", slugify(p.Name)+".csv"))
+			return writeRoundsCSV(w, res.Result)
+		}
+		return errors.Errorf("no results for %q", p.Name)
+	})
+}
+
+// handleBLT serves the ballots for a position as a ballot file.
+func (s *server) handleBLT(w http.ResponseWriter, r *http.Request) {
+	p, ok := exportPosition(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.handleExport(w, r, func(ballots []*Ballot, results *Results) error {
+		var buf bytes.Buffer
+		if err := writeBLT(&buf, p, ballots); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", slugify(p.Name)+".blt"))
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWriteBLT(t *testing.T) {
+	p := Position{
+		Name:       "President",
+		Candidates: []string{"Alice", "Bob", `Carol "CJ" Jones`},
+		Withdrawn:  []string{"Bob"},
+	}
+	ballots := []*Ballot{
+		{Tracker: "A", Positions: map[string][]string{"President": {"Alice", "Bob"}}},
+		{Tracker: "B", Positions: map[string][]string{"Other": {"Alice"}}},
+		{Tracker: "C", Positions: map[string][]string{"President": {"Reopen Nominations"}}},
+	}
+	var buf bytes.Buffer
+	if err := writeBLT(&buf, p, ballots); err != nil {
+		t.Fatal(err)
+	}
+	want := `4 1
+-2
+1 1 2 0
+1 4 0
+0
+"Alice"
+"Bob"
+"Carol 'CJ' Jones"
+"Reopen Nominations"
+"President"
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", buf.String(), want)
+	}
+
+	ballots = append(ballots, &Ballot{Tracker: "D", Positions: map[string][]string{"President": {"Dave"}}})
+	if err := writeBLT(&buf, p, ballots); err == nil {
+		t.Errorf("expected error for unknown candidate")
+	}
+}
+
+func TestWriteRoundsCSV(t *testing.T) {
+	res := &Result{
+		Candidates: []string{"A", "B", "C"},
+		Quota:      2.5,
+		Rounds: []Round{
+			{Tallies: map[string]float64{"A": 2, "B": 1.5, "C": 1}, Excluded: "C"},
+			{Tallies: map[string]float64{"A": 3, "B": 1.5}, Exhausted: 0.5, Elected: []string{"A"}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeRoundsCSV(&buf, res); err != nil {
+		t.Fatal(err)
+	}
+	want := `round,A,B,C,exhausted,quota,elected,excluded,transferred
+1,2,1.5,1,0,2.5,,C,
+2,3,1.5,,0.5,2.5,A,,
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", buf.String(), want)
+	}
+}
+
+func TestExports(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	castVote(t, s, goodForm())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := get("/admin/results.json"); resp.Code != http.StatusForbidden {
+		t.Fatalf("expected StatusForbidden; got %d", resp.Code)
+	}
+	c.Admins = []string{"test"}
+
+	resp := get("/admin/results.json")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	var results Results
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if results.ElectionID != "test" || results.Ballots != 1 || len(results.Positions) != len(c.Positions) {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if p := results.Positions[0]; p.Position != "Position 1" || p.Ballots != 1 || p.Result == nil || p.Result.Winners[0] != "Candidate 2" {
+		t.Errorf("unexpected Position 1 results: %+v", p)
+	}
+	if p := results.Positions[5]; p.Error == "" {
+		t.Errorf("expected error for position without ballots: %+v", p)
+	}
+
+	resp = get("/admin/results.csv?position=" + url.QueryEscape("Position 5"))
+	if resp.Code != http.StatusOK || !strings.HasPrefix(resp.Body.String(), "round,Candidate 6,Candidate 7,Candidate 8,Reopen Nominations,exhausted") {
+		t.Fatalf("unexpected CSV: %s", resp.Body.Bytes())
+	}
+
+	resp = get("/admin/ballots.blt?position=" + url.QueryEscape("Position 5"))
+	if resp.Code != http.StatusOK || !strings.HasPrefix(resp.Body.String(), "4 1\n1 2 1 0\n0\n") {
+		t.Fatalf("unexpected BLT: %s", resp.Body.Bytes())
+	}
+
+	if resp := get("/admin/ballots.blt?position=Nope"); resp.Code != http.StatusNotFound {
+		t.Fatalf("expected StatusNotFound; got %d", resp.Code)
+	}
+}
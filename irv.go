@@ -0,0 +1,76 @@
+package main
+
+import "github.com/pkg/errors"
+
+// IRVPoll counts ranked ballots for a single seat using instant-runoff
+// voting.
+type IRVPoll struct {
+	ballotBox
+}
+
+// NewIRVPoll creates an instant-runoff poll between candidates.
+func NewIRVPoll(candidates []string) (*IRVPoll, error) {
+	box, err := newBallotBox(candidates)
+	if err != nil {
+		return nil, errors.Wrap(err, "irv")
+	}
+	return &IRVPoll{ballotBox: box}, nil
+}
+
+// Evaluate excludes the candidate with the fewest votes each round until one
+// candidate holds a majority of the continuing ballots.
+func (p *IRVPoll) Evaluate() (*Result, error) {
+	if len(p.ballots) == 0 {
+		return nil, errors.New("irv: no ballots")
+	}
+	res := &Result{
+		Method:     MethodIRV,
+		Candidates: p.candidates,
+		Seats:      1,
+	}
+	tb := p.newTieBreaker()
+	tb.describe(res)
+	excluded := map[string]bool{}
+	for {
+		round := Round{Tallies: map[string]float64{}}
+		var continuing []string
+		for _, c := range p.candidates {
+			if !excluded[c] {
+				continuing = append(continuing, c)
+				round.Tallies[c] = 0
+			}
+		}
+		total := 0.0
+		for _, ballot := range p.ballots {
+			counted := false
+			for _, c := range ballot {
+				if !excluded[c] {
+					round.Tallies[c]++
+					total++
+					counted = true
+					break
+				}
+			}
+			if !counted {
+				round.Exhausted++
+			}
+		}
+
+		for _, c := range continuing {
+			if round.Tallies[c]*2 > total || len(continuing) == 1 {
+				round.Elected = []string{c}
+				res.Winners = round.Elected
+				res.Rounds = append(res.Rounds, round)
+				return res, nil
+			}
+		}
+
+		var err error
+		round.Excluded, round.Tied, round.TieBreak, err = tb.lowest(continuing, round, res.Rounds)
+		if err != nil {
+			return nil, err
+		}
+		excluded[round.Excluded] = true
+		res.Rounds = append(res.Rounds, round)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Kinds of email.
+const (
+	MailInvitation   = "invitation"
+	MailConfirmation = "confirmation"
+)
+
+const (
+	// mailMaxAttempts is how many times a message is tried before giving up.
+	mailMaxAttempts = 8
+	// mailRetryDelay is how long to wait after the first failed attempt to
+	// send a message. It doubles with each attempt.
+	mailRetryDelay = time.Minute
+	// mailTimeout limits each conversation with the relay.
+	mailTimeout = 30 * time.Second
+)
+
+// SMTPConfig is the mail relay used to send invitations and confirmations.
+type SMTPConfig struct {
+	// Host and Port of the relay. Mail is only sent if Host is set. Port
+	// defaults to 25.
+	Host string
+	Port int
+	// Username and Password, the path of a file containing the password,
+	// are used to log in to the relay if set.
+	Username string
+	Password string
+	// From is the sender, e.g. "CSSS Elections <elections@ubccsss.org>".
+	From string
+	// Domain is added to usernames to email voters without an email address
+	// on the roll, e.g. "students.cs.ubc.ca".
+	Domain string
+	// URL is the URL of elections.cgi, linked to in emails.
+	URL string
+	// Confirmations emails voters their signed receipt when a ballot is cast
+	// with their account.
+	Confirmations bool
+}
+
+// OutboxMessage is an email waiting to be sent, or that has been.
+type OutboxMessage struct {
+	ID      uint `gorm:"primary_key"`
+	Kind    string
+	To      string
+	Subject string
+	// Body is cleared once the message is sent or given up on, since
+	// invitations contain voting tokens and confirmations receipts.
+	Body string `sql:"type:text"`
+	// Attempts is how many times sending the message has been tried, and
+	// LastError why the last one failed.
+	Attempts  int
+	LastError string
+	// NextAttempt is when to try sending the message next.
+	NextAttempt time.Time `sql:"index"`
+	SentAt      *time.Time
+	CreatedAt   time.Time
+}
+
+// TableName implements gorm.tabler.
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// mailEnabled reports whether an SMTP relay is configured.
+func mailEnabled() bool {
+	return c.SMTP.Host != ""
+}
+
+// mailAddress returns where to email a voter: their email address from the
+// roll, or their username at the configured domain. It returns "" if neither
+// is known.
+func mailAddress(email, username string) string {
+	if email != "" {
+		return email
+	}
+	if username != "" && c.SMTP.Domain != "" {
+		return username + "@" + c.SMTP.Domain
+	}
+	return ""
+}
+
+// queueMail adds a message to the outbox.
+func queueMail(db *gorm.DB, kind, to, subject, body string) error {
+	if _, err := mail.ParseAddress(to); err != nil {
+		return errors.Wrapf(err, "email address %q", to)
+	}
+	return db.Create(&OutboxMessage{
+		Kind:        kind,
+		To:          to,
+		Subject:     subject,
+		Body:        body,
+		NextAttempt: now(),
+	}).Error
+}
+
+// formatMail returns a message with its headers, ready to send.
+func formatMail(config SMTPConfig, msg *OutboxMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", config.From},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		if strings.ContainsAny(header[1], "\r\n") {
+			return nil, errors.Errorf("invalid %s header %q", header[0], header[1])
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(strings.Replace(msg.Body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendMail sends a message through the relay, using STARTTLS if the relay
+// supports it.
+func sendMail(config SMTPConfig, msg *OutboxMessage) error {
+	body, err := formatMail(config, msg)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return errors.Wrapf(err, "smtp: from %q", config.From)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = 25
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(config.Host, strconv.Itoa(port)), mailTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
+			return err
+		}
+	}
+	if config.Username != "" {
+		password, err := ioutil.ReadFile(config.Password)
+		if err != nil {
+			return errors.Wrap(err, "smtp: password")
+		}
+		auth := smtp.PlainAuth("", config.Username, strings.TrimSpace(string(password)), config.Host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// pendingMail returns the queued messages that are due to be sent.
+func pendingMail(db *gorm.DB) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	err := db.Where("sent_at IS NULL AND attempts < ? AND next_attempt <= ?", mailMaxAttempts, now()).Order("id").Find(&messages).Error
+	return messages, err
+}
+
+// deliverMail tries to send messages through the relay and records the
+// outcome of each. Messages that fail are retried later with exponential
+// backoff, up to mailMaxAttempts times. It returns how many were sent.
+func deliverMail(db *gorm.DB, config SMTPConfig, messages []OutboxMessage) (int, error) {
+	sent := 0
+	for _, msg := range messages {
+		msg := msg
+		msg.Attempts++
+		if err := sendMail(config, &msg); err != nil {
+			log.Printf("sending %s to %s: %s", msg.Kind, msg.To, err)
+			msg.LastError = err.Error()
+			msg.NextAttempt = now().Add(mailRetryDelay << uint(msg.Attempts-1))
+			if msg.Attempts >= mailMaxAttempts {
+				clearMail(&msg)
+			}
+		} else {
+			t := now()
+			msg.SentAt = &t
+			clearMail(&msg)
+			msg.LastError = ""
+			sent++
+		}
+		if err := db.Save(&msg).Error; err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// clearMail removes what a message that has been sent or given up on no
+// longer needs: its body and, if the roll is hashed, who a confirmation was
+// for, since it shows they voted.
+func clearMail(msg *OutboxMessage) {
+	msg.Body = ""
+	if msg.Kind == MailConfirmation && hashedRoll() {
+		msg.To = ""
+	}
+}
+
+// flushOutbox tries to send the queued messages that are due, returning how
+// many were sent.
+func flushOutbox(db *gorm.DB) (int, error) {
+	messages, err := pendingMail(db)
+	if err != nil {
+		return 0, err
+	}
+	return deliverMail(db, c.SMTP, messages)
+}
+
+// voteLink returns the link to vote, with a voting token if set.
+func voteLink(token string) string {
+	link := strings.TrimSuffix(c.SMTP.URL, "/") + "/"
+	if token != "" {
+		link += "?token=" + token
+	}
+	return link
+}
+
+// invitationMail returns the subject and body of an invitation to vote.
+func invitationMail(entry RollEntry, token string) (string, string) {
+	var body strings.Builder
+	if entry.Name != "" {
+		fmt.Fprintf(&body, "Hi %s,\n\n", entry.Name)
+	} else {
+		body.WriteString("Hi,\n\n")
+	}
+	body.WriteString("You're invited to vote in the UBC Computer Science Student Society's elections")
+	if schedule, err := c.Schedule(); err == nil && !schedule.ClosesAt.IsZero() {
+		fmt.Fprintf(&body, ", which close %s", formatScheduleTime(schedule.ClosesAt))
+	}
+	fmt.Fprintf(&body, ".\n\nVote at: %s\n", voteLink(token))
+	if token != "" {
+		fmt.Fprintf(&body, "\nThis link contains your personal one-time voting token, %s, so don't share it. "+
+			"You'll also need your student number.\n", token)
+	}
+	fmt.Fprintf(&body, "\nIf you have any questions, please contact the elections officer at %s.\n", c.Email)
+	return "Vote in the CSSS elections", body.String()
+}
+
+// confirmationMail returns the subject and body of the confirmation that a
+// ballot was cast with a voter's account at t, containing its signed receipt.
+func confirmationMail(t time.Time, receipt []byte) (string, string) {
+	if loc, err := c.location(); err == nil {
+		t = t.In(loc)
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "A ballot was cast in the CSSS elections (%s) with your account on %s.\n\n",
+		c.ElectionID, formatScheduleTime(t))
+	body.WriteString("Its signed receipt is below. Keep it to check your ballot on the bulletin board " +
+		"by its tracker code once voting closes, and don't share it, since it shows how you voted.\n\n")
+	body.Write(receipt)
+	body.WriteString("\n")
+	fmt.Fprintf(&body, "\nIf you didn't vote, please contact the elections officer at %s right away.\n", c.Email)
+	return "You voted in the CSSS elections", body.String()
+}
+
+// confirmationAddress returns where to send the confirmation of a vote, or
+// "" if confirmations aren't sent or the voter's address isn't known. Voters
+// with a token from an invitation are sent it where the invitation was sent.
+// A hashed roll has no addresses, so other voters are only sent it at their
+// username at the configured domain, which needs them to log in.
+func confirmationAddress(db *gorm.DB, r *http.Request) (string, error) {
+	if !mailEnabled() || !c.SMTP.Confirmations {
+		return "", nil
+	}
+	if token := votingToken(r); token != nil {
+		if token.Address != "" {
+			return validMailAddress(token.Address), nil
+		}
+		if hashedRoll() {
+			return "", nil
+		}
+		return validMailAddress(mailAddress(token.Entry.Email, token.Entry.Username)), nil
+	}
+	user := remoteUser(r)
+	email := ""
+	if !hashedRoll() {
+		entry, err := rollEntryForUser(db, user)
+		if err != nil {
+			return "", err
+		}
+		if entry != nil {
+			email = entry.Email
+		}
+	}
+	return validMailAddress(mailAddress(email, user)), nil
+}
+
+// validMailAddress returns to, or "" if it isn't a valid address, so that a
+// mistake on the roll doesn't stop anyone voting.
+func validMailAddress(to string) string {
+	if to == "" {
+		return ""
+	}
+	if _, err := mail.ParseAddress(to); err != nil {
+		log.Printf("not sending confirmation to %q: %s", to, err)
+		return ""
+	}
+	return to
+}
+
+// queueInvitations queues an invitation to each voter on the roll who hasn't
+// voted and has an email address. Voters who've already been invited are
+// skipped unless resend is set. If tokens is set, each invitation contains a
+// new voting token, replacing any unused one. The tokens are issued in the
+// same transaction as the invitations are queued, so voters keep their old
+// tokens if anything fails. It returns how many were queued.
+func queueInvitations(db *gorm.DB, entries []RollEntry, sidKeys []string, tokens, resend bool) (int, error) {
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	var invite []RollEntry
+	var inviteKeys, addresses []string
+	for i, entry := range entries {
+		voted := 0
+		if err := tx.Model(&Voter{}).Where("student_number = ?", sidKeys[i]).Count(&voted).Error; err != nil {
+			return 0, err
+		}
+		to := mailAddress(entry.Email, entry.Username)
+		if voted > 0 || to == "" {
+			continue
+		}
+		if !resend {
+			count := 0
+			if err := tx.Model(&OutboxMessage{}).Where("kind = ? AND \"to\" = ?", MailInvitation, to).Count(&count).Error; err != nil {
+				return 0, err
+			}
+			if count > 0 {
+				continue
+			}
+		}
+		invite = append(invite, entry)
+		inviteKeys = append(inviteKeys, sidKeys[i])
+		addresses = append(addresses, to)
+	}
+
+	issued := map[string]string{}
+	if tokens && len(invite) > 0 {
+		var err error
+		if issued, err = createTokens(tx, inviteKeys, true); err != nil {
+			return 0, err
+		}
+	}
+	for i, entry := range invite {
+		token := issued[inviteKeys[i]]
+		subject, body := invitationMail(entry, token)
+		if err := queueMail(tx, MailInvitation, addresses[i], subject, body); err != nil {
+			return 0, err
+		}
+		if token != "" {
+			if err := setTokenAddress(tx, token, addresses[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+
+	if len(issued) > 0 {
+		audit(AuditTokensIssued, map[string]string{"tokens": strconv.Itoa(len(issued))})
+	}
+	audit(AuditInvitations, map[string]string{"invitations": strconv.Itoa(len(invite))})
+	return len(invite), nil
+}
+
+// openMailDB loads the config and opens the database for the mail commands.
+func openMailDB() (*gorm.DB, error) {
+	if err := loadConfig(); err != nil {
+		return nil, err
+	}
+	if !mailEnabled() {
+		return nil, errors.New("smtp: host isn't set in config.yml")
+	}
+	db, err := gorm.Open("sqlite3", c.DBPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to database")
+	}
+	if err := runMigrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// runSendInvitations implements the send-invitations command.
+func runSendInvitations(args []string) error {
+	fs := flag.NewFlagSet("send-invitations", flag.ExitOnError)
+	tokens := fs.Bool("tokens", false, "include a new one-time voting token in each invitation")
+	resend := fs.Bool("resend", false, "invite voters who have already been invited again")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections send-invitations [-tokens] [-resend] [roll.csv|roll.json]\n\n"+
+			"Emails an invitation to vote to everyone on the roll who hasn't voted. If the\n"+
+			"roll is hashed, pass the unhashed roll file to find voters' email addresses.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one roll file")
+	}
+
+	db, err := openMailDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if c.SMTP.URL == "" {
+		return errors.New("smtp: url must be set to link to the election")
+	}
+	entries, sidKeys, err := loadUnhashedRoll(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	queued, err := queueInvitations(db, entries, sidKeys, *tokens, *resend)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Queued %d invitations.\n", queued)
+	return runSendMail(nil)
+}
+
+// runSendMail implements the send-mail command.
+func runSendMail(args []string) error {
+	fs := flag.NewFlagSet("send-mail", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections send-mail\n\n"+
+			"Sends queued emails that are due, for running from cron.\n")
+	}
+	fs.Parse(args)
+
+	db, err := openMailDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	sent, err := flushOutbox(db)
+	if err != nil {
+		return err
+	}
+
+	pending, failed := 0, 0
+	if err := db.Model(&OutboxMessage{}).Where("sent_at IS NULL AND attempts < ?", mailMaxAttempts).Count(&pending).Error; err != nil {
+		return err
+	}
+	var failures []OutboxMessage
+	if err := db.Where("sent_at IS NULL AND attempts >= ?", mailMaxAttempts).Find(&failures).Error; err != nil {
+		return err
+	}
+	failed = len(failures)
+	fmt.Fprintf(os.Stderr, "Sent %d emails, %d waiting to be retried, %d failed.\n", sent, pending, failed)
+	for _, msg := range failures {
+		fmt.Fprintf(os.Stderr, "- %s to %s: %s\n", msg.Kind, msg.To, msg.LastError)
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is a local SMTP server that records the messages it receives.
+type smtpSink struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	failRcpt bool
+	messages []*mail.Message
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO", "HELO", "MAIL", "RSET", "NOOP":
+			reply("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			fail := s.failRcpt
+			s.mu.Unlock()
+			if fail {
+				reply("451 try again later")
+			} else {
+				reply("250 OK")
+			}
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				reply("554 " + err.Error())
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+// received returns the messages received so far.
+func (s *smtpSink) received() []*mail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mail.Message(nil), s.messages...)
+}
+
+func mailBody(t *testing.T, msg *mail.Message) string {
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(string(body), "\r\n", "\n", -1)
+}
+
+func TestMail(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+	defer func() { now = time.Now }()
+
+	sink := newSMTPSink(t)
+	defer sink.l.Close()
+	host, port, err := net.SplitHostPort(sink.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Email = "officer@example.com"
+	c.SMTP = SMTPConfig{
+		Host:          host,
+		From:          "CSSS Elections <elections@example.com>",
+		Domain:        "example.com",
+		URL:           "https://example.com/elections.cgi",
+		Confirmations: true,
+	}
+	if c.SMTP.Port, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []RollEntry{
+		{StudentNumber: "12345678", Username: "test", Name: "Test Voter", Email: "voter@mail.example.com"},
+		{StudentNumber: "23456789", Username: "other"},
+	}
+	if err := importRoll(s.db, entries); err != nil {
+		t.Fatal(err)
+	}
+	sids := []string{"12345678", "23456789"}
+
+	// Voters keep their tokens if invitations can't be queued.
+	held, err := issueTokens(s.db, sids[1:], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := append([]RollEntry(nil), entries...)
+	invalid[0].Email = "not an address"
+	if _, err := queueInvitations(s.db, invalid, sids, true, false); err == nil {
+		t.Fatalf("expected invalid address to fail")
+	}
+	if _, err := lookupToken(s.db, held[sids[1]]); err != nil {
+		t.Errorf("expected token to survive the failed invitations: %v", err)
+	}
+	count := 0
+	if err := s.db.Model(&OutboxMessage{}).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("expected nothing to be queued; got %d, %v", count, err)
+	}
+
+	// Invitations.
+	if queued, err := queueInvitations(s.db, entries, sids, true, false); err != nil || queued != 2 {
+		t.Fatalf("expected 2 invitations; got %d, %v", queued, err)
+	}
+	if sent, err := flushOutbox(s.db); err != nil || sent != 2 {
+		t.Fatalf("expected 2 emails sent; got %d, %v", sent, err)
+	}
+	invitations := sink.received()
+	if len(invitations) != 2 {
+		t.Fatalf("expected 2 emails received; got %d", len(invitations))
+	}
+	if to := invitations[1].Header.Get("To"); to != "other@example.com" {
+		t.Errorf("expected invitation to username at the domain; got %q", to)
+	}
+	body := mailBody(t, invitations[0])
+	if to := invitations[0].Header.Get("To"); to != "voter@mail.example.com" {
+		t.Errorf("expected invitation to the roll's email address; got %q", to)
+	}
+	link := "https://example.com/elections.cgi/?token="
+	i := strings.Index(body, link)
+	if !strings.HasPrefix(body, "Hi Test Voter,") || i < 0 {
+		t.Fatalf("unexpected invitation:\n%s", body)
+	}
+	token := strings.Fields(body[i+len(link):])[0]
+	if voter, err := lookupToken(s.db, token); err != nil || voter.Entry.StudentNumber != sids[0] {
+		t.Errorf("expected invitation to contain the voter's token; got %v, %v", voter, err)
+	}
+	if queued, err := queueInvitations(s.db, entries, sids, false, false); err != nil || queued != 0 {
+		t.Errorf("expected invited voters to be skipped; got %d, %v", queued, err)
+	}
+
+	var sent OutboxMessage
+	if err := s.db.Where("\"to\" = ?", "other@example.com").First(&sent).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sent.SentAt == nil || sent.Body != "" {
+		t.Errorf("expected sent message to be marked sent and cleared; got %+v", sent)
+	}
+
+	// Failed messages are retried with backoff.
+	sink.mu.Lock()
+	sink.failRcpt = true
+	sink.mu.Unlock()
+	if err := queueMail(s.db, MailInvitation, "retry@example.com", "Retry", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if sent, err := flushOutbox(s.db); err != nil || sent != 0 {
+		t.Fatalf("expected sending to fail; got %d, %v", sent, err)
+	}
+	var retry OutboxMessage
+	if err := s.db.Where("\"to\" = ?", "retry@example.com").First(&retry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if retry.Attempts != 1 || !strings.Contains(retry.LastError, "451") || retry.SentAt != nil {
+		t.Errorf("expected failed attempt to be recorded; got %+v", retry)
+	}
+	sink.mu.Lock()
+	sink.failRcpt = false
+	sink.mu.Unlock()
+	if sent, err := flushOutbox(s.db); err != nil || sent != 0 {
+		t.Errorf("expected message not to be retried before the delay; got %d, %v", sent, err)
+	}
+	start := time.Now()
+	now = func() time.Time { return start.Add(2 * mailRetryDelay) }
+	if sent, err := flushOutbox(s.db); err != nil || sent != 1 {
+		t.Errorf("expected message to be retried; got %d, %v", sent, err)
+	}
+	now = time.Now
+
+	// Messages that have given up are cleared.
+	sink.mu.Lock()
+	sink.failRcpt = true
+	sink.mu.Unlock()
+	if err := queueMail(s.db, MailInvitation, "fail@example.com", "Fail", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Model(&OutboxMessage{}).Where("\"to\" = ?", "fail@example.com").Update("attempts", mailMaxAttempts-1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := flushOutbox(s.db); err != nil {
+		t.Fatal(err)
+	}
+	var failed OutboxMessage
+	if err := s.db.Where("\"to\" = ?", "fail@example.com").First(&failed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if failed.Attempts != mailMaxAttempts || failed.Body != "" {
+		t.Errorf("expected message to give up and be cleared; got %+v", failed)
+	}
+	sink.mu.Lock()
+	sink.failRcpt = false
+	sink.mu.Unlock()
+
+	// Confirmations.
+	before := len(sink.received())
+	req := httptest.NewRequest("POST", "/vote", nil)
+	req.Form = goodForm()
+	addCSRF(t, req)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if got := len(sink.received()); got != before {
+		t.Errorf("expected confirmation to be queued rather than sent while the voter waits; got %d emails", got-before)
+	}
+	var queued OutboxMessage
+	if err := s.db.Where("kind = ?", MailConfirmation).First(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sent, err := flushOutbox(s.db); err != nil || sent != 1 {
+		t.Fatalf("expected confirmation to be sent; got %d, %v", sent, err)
+	}
+	received := sink.received()
+	if len(received) != before+1 {
+		t.Fatalf("expected a confirmation to be sent; got %d emails", len(received)-before)
+	}
+	confirmation := received[before]
+	if to := confirmation.Header.Get("To"); to != "voter@mail.example.com" {
+		t.Errorf("expected confirmation to the voter; got %q", to)
+	}
+	var ballot BallotRecord
+	if err := s.db.First(&ballot).Error; err != nil {
+		t.Fatal(err)
+	}
+	body = mailBody(t, confirmation)
+	if body != strings.Replace(queued.Body, "\r\n", "\n", -1) {
+		t.Errorf("sent confirmation differs from the queued one:\n%s", body)
+	}
+	if !strings.Contains(body, "If you didn't vote") {
+		t.Errorf("unexpected confirmation:\n%s", body)
+	}
+	if receipt := confirmationReceipt(t, body); receipt.Ballot.Tracker != ballot.Tracker {
+		t.Errorf("expected confirmation to contain the ballot's receipt; got tracker %q", receipt.Ballot.Tracker)
+	}
+	if err := s.db.First(&queued, queued.ID).Error; err != nil || queued.Body != "" || queued.To == "" {
+		t.Errorf("expected sent confirmation to be cleared; got %+v, %v", queued, err)
+	}
+}
+
+// confirmationReceipt returns the verified receipt in a confirmation.
+func confirmationReceipt(t *testing.T, body string) *Receipt {
+	start, end := strings.Index(body, "{"), strings.Index(body, "\n}\n")
+	if start < 0 || end < start {
+		t.Fatalf("expected confirmation to contain the receipt:\n%s", body)
+	}
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := verifyReceipt(&key.PublicKey, []byte(body[start:end+2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipt
+}
+
+func TestHashedRollConfirmations(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	sink := newSMTPSink(t)
+	defer sink.l.Close()
+	host, port, err := net.SplitHostPort(sink.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SMTP = SMTPConfig{
+		Host:          host,
+		From:          "CSSS Elections <elections@example.com>",
+		Domain:        "example.com",
+		URL:           "https://example.com/elections.cgi",
+		Confirmations: true,
+	}
+	if c.SMTP.Port, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+	c.RollSecret = filepath.Join(filepath.Dir(c.PrivateKey), "roll.key")
+	if err := ioutil.WriteFile(c.RollSecret, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := loadRollSecret(c.RollSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hashed roll has no addresses, so they come from the unhashed one.
+	entries := []RollEntry{{StudentNumber: "12345678", Username: "test", Name: "Test Voter", Email: "voter@mail.example.com"}}
+	hashed := append([]RollEntry(nil), entries...)
+	if err := hashRoll(secret, hashed, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := importRoll(s.db, hashed); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := queueInvitations(s.db, entries, []string{hashed[0].StudentNumber}, true, false); err != nil || queued != 1 {
+		t.Fatalf("expected 1 invitation; got %d, %v", queued, err)
+	}
+	if _, err := flushOutbox(s.db); err != nil {
+		t.Fatal(err)
+	}
+	body := mailBody(t, sink.received()[0])
+	link := "https://example.com/elections.cgi/?token="
+	token := strings.Fields(body[strings.Index(body, link)+len(link):])[0]
+	var record VotingToken
+	if err := s.db.Where("hash = ?", hashToken(token)).First(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Address) == 0 || strings.Contains(string(record.Address), "voter@") {
+		t.Errorf("expected the invitation's address to be stored encrypted; got %q", record.Address)
+	}
+
+	// Voting with the token sends the confirmation where the invitation went.
+	os.Setenv("REMOTE_USER", "")
+	defer os.Setenv("REMOTE_USER", "test")
+	req := httptest.NewRequest("POST", "/vote", nil)
+	req.Form = goodForm()
+	req.Form.Set("token", token)
+	addCSRF(t, req)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if sent, err := flushOutbox(s.db); err != nil || sent != 1 {
+		t.Fatalf("expected confirmation to be sent; got %d, %v", sent, err)
+	}
+	confirmation := sink.received()[1]
+	if to := confirmation.Header.Get("To"); to != "voter@mail.example.com" {
+		t.Errorf("expected confirmation to the invitation's address; got %q", to)
+	}
+	confirmationReceipt(t, mailBody(t, confirmation))
+
+	// Once sent, the outbox doesn't show who voted.
+	var queued OutboxMessage
+	if err := s.db.Where("kind = ?", MailConfirmation).First(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	if queued.To != "" || queued.Body != "" {
+		t.Errorf("expected sent confirmation to be cleared; got %+v", queued)
+	}
+}
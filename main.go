@@ -2,13 +2,8 @@ package main
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rand"
-	"crypto/sha1"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"html/template"
@@ -24,10 +19,10 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/Sam-Izdat/govote"
 	"github.com/gosimple/slug"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -128,6 +123,8 @@ func (w *TemplateWriter) Close() error {
 	return nil
 }
 
+// handleErr wraps a handler, showing an error page if it fails. Error
+// messages can contain what was submitted, so they're escaped.
 func handleErr(f func(w *TemplateWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
@@ -143,8 +140,8 @@ func handleErr(f func(w *TemplateWriter, r *http.Request) error) http.HandlerFun
 				<p style="color: red">%s</p>
 				<p>If the error persists, please contact the elections officer (<a href="mailto:%s">%s</a>).</p>
 				<button onclick="window.history.back()">Go Back</button>`,
-				err.Error(),
-				c.Email, c.Email,
+				template.HTMLEscapeString(err.Error()),
+				template.HTMLEscapeString(c.Email), template.HTMLEscapeString(c.Email),
 			)
 
 			log.Printf("Error: %+v", err)
@@ -162,13 +159,6 @@ type Voter struct {
 	DeletedAt *time.Time `sql:"index"`
 }
 
-type Vote struct {
-	gorm.Model
-
-	Position  string
-	Candidate string
-}
-
 type Biography struct {
 	Name      string
 	Desc      string
@@ -180,23 +170,190 @@ type Position struct {
 	Name       string
 	Desc       string
 	Candidates []string
+	// Seats is the number of candidates elected to this position.
+	Seats int
+	// Method is the voting method used to count this position. It defaults to
+	// "irv" for single seat positions and "stv" otherwise.
+	Method string
+	// Transfer selects the STV surplus transfer method, either "gregory"
+	// (default) or "meek".
+	Transfer string
+	// Eligible restricts who can vote for this position.
+	Eligible Eligibility
+	// Withdrawn lists candidates who have dropped out. They stay on ballots
+	// already cast but are skipped when counting.
+	Withdrawn []string
+}
+
+// IsWithdrawn reports whether the candidate has withdrawn.
+func (p Position) IsWithdrawn(candidate string) bool {
+	for _, name := range p.Withdrawn {
+		if name == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// Running returns the candidates who haven't withdrawn.
+func (p Position) Running() []string {
+	var running []string
+	for _, candidate := range p.Candidates {
+		if !p.IsWithdrawn(candidate) {
+			running = append(running, candidate)
+		}
+	}
+	return running
+}
+
+// skipWithdrawn returns the ranking without any withdrawn candidates and
+// whether any were removed.
+func (p Position) skipWithdrawn(ranking []string) ([]string, bool) {
+	if len(p.Withdrawn) == 0 {
+		return ranking, false
+	}
+	var skipped []string
+	for _, candidate := range ranking {
+		if !p.IsWithdrawn(candidate) {
+			skipped = append(skipped, candidate)
+		}
+	}
+	return skipped, len(skipped) != len(ranking)
+}
+
+// NumSeats returns the number of seats to fill, which is at least one.
+func (p Position) NumSeats() int {
+	if p.Seats < 1 {
+		return 1
+	}
+	return p.Seats
+}
+
+// MethodName returns the name of the voting method used to count this
+// position.
+func (p Position) MethodName() string {
+	if p.Method != "" {
+		return p.Method
+	}
+	if p.NumSeats() > 1 {
+		return MethodSTV
+	}
+	return MethodIRV
+}
+
+// Tallier returns a new Tallier for counting this position.
+func (p Position) Tallier() (Tallier, error) {
+	method, ok := methods[p.MethodName()]
+	if !ok {
+		return nil, errors.Errorf("position %q: unknown method %q", p.Name, p.MethodName())
+	}
+	if p.NumSeats() > 1 && !method.MultiSeat {
+		return nil, errors.Errorf("position %q: method %q can only fill one seat", p.Name, p.MethodName())
+	}
+	for _, name := range p.Withdrawn {
+		found := false
+		for _, candidate := range p.Candidates {
+			found = found || candidate == name
+		}
+		if !found {
+			return nil, errors.Errorf("position %q: withdrawn candidate %q isn't a candidate", p.Name, name)
+		}
+	}
+	candidates := append(p.Running(), "Reopen Nominations")
+	tallier, err := method.New(candidates, TallyOptions{
+		Seats:    p.NumSeats(),
+		Transfer: p.Transfer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tallier.SetTieBreak(c.TieBreak)
+	return tallier, nil
+}
+
+// reservedChoices are choices on every position's ballot, so no candidate
+// can use their names.
+var reservedChoices = []string{"Abstain", "Reopen Nominations"}
+
+// Validate checks that the position can be voted on: each candidate has a
+// distinct name and form field, none is named like a reserved choice, and
+// it can be tallied.
+func (p Position) Validate() error {
+	fields := map[string]string{
+		slugify(p.Name + "-reopen"):  "Reopen Nominations",
+		slugify(p.Name + "-abstain"): "Abstain",
+	}
+	for _, candidate := range p.Candidates {
+		if strings.TrimSpace(candidate) == "" || slugify(candidate) == "" {
+			return errors.Errorf("position %q: candidate %q needs a name with letters or numbers", p.Name, candidate)
+		}
+		for _, reserved := range reservedChoices {
+			if strings.EqualFold(strings.TrimSpace(candidate), reserved) {
+				return errors.Errorf("position %q: candidates can't be named %q", p.Name, reserved)
+			}
+		}
+		field := slugify(p.Name + "-" + candidate)
+		if other, ok := fields[field]; ok {
+			return errors.Errorf("position %q: candidate %q is too similar to %q", p.Name, candidate, other)
+		}
+		fields[field] = candidate
+	}
+	_, err := p.Tallier()
+	return err
 }
 
 type Config struct {
-	Open       bool
+	// ElectionID identifies this election in voter receipts.
+	ElectionID string
+	// Open is whether voting is open, unless it is scheduled with OpensAt
+	// and ClosesAt.
+	Open bool
+	// PollOverride is PollOpen or PollClosed if polls were opened or closed
+	// from the admin console, on top of Open and the schedule.
+	PollOverride string `yaml:"-"`
+	// OpensAt and ClosesAt schedule voting, e.g. "2022-03-28 09:00" in
+	// Timezone (e.g. "America/Vancouver"). Either may be left empty.
+	OpensAt    string `yaml:"opens_at"`
+	ClosesAt   string `yaml:"closes_at"`
+	Timezone   string
 	Log        string
 	Admins     []string
 	DBPath     string
 	Email      string
 	StudentIDs string
 	PrivateKey string
-	Bios       []Biography
-	Positions  []Position
+	// RollSecret is the path of the secret key used to hash student numbers
+	// and usernames. If set, only hashes of them are stored.
+	RollSecret string
+	// AuditLog is the path of the hash-chained audit log.
+	AuditLog string
+	// Auth is how voters and admins log in. By default the web server
+	// does, and sets REMOTE_USER.
+	Auth AuthConfig
+	// SMTP is the mail relay used to email voters.
+	SMTP        SMTPConfig
+	Bios        []Biography
+	Positions   []Position
+	Referendums []Referendum
+	TieBreak    TieBreak
+}
+
+// Ballot is a voter's validated choices.
+type Ballot struct {
+	// Positions maps position names to the ranked candidates.
+	Positions map[string][]string `json:"positions"`
+	// Referendums maps referendum questions to the chosen option.
+	Referendums map[string]string `json:"referendums"`
+	// Tracker is the random code the voter can use to find their ballot on
+	// the bulletin board.
+	Tracker string `json:"tracker"`
 }
 
 var (
 	migrate = flag.Bool("migrate", false, "migrate the database")
 	index   = flag.Bool("index", false, "generate index.html")
+
+	resultsPage = flag.Bool("results", false, "generate results.html once polls close")
 )
 var c Config
 
@@ -204,7 +361,7 @@ func slugify(s string) string {
 	return slug.Make(s)
 }
 
-func validateVoteForm(r *http.Request) (*Voter, map[string][]string, error) {
+func validateVoteForm(db *gorm.DB, r *http.Request) (*Voter, *Ballot, error) {
 	name := strings.TrimSpace(r.FormValue("name"))
 	if name == "" {
 		return nil, nil, errors.New("All fields are required. You need to specify your full name.")
@@ -214,6 +371,11 @@ func validateVoteForm(r *http.Request) (*Voter, map[string][]string, error) {
 		return nil, nil, errors.New("All fields are required. Student number missing.")
 	}
 
+	entry, userKey, err := voterIdentity(db, r, sid)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	type rank struct {
 		rank   int
 		choice string
@@ -222,7 +384,19 @@ func validateVoteForm(r *http.Request) (*Voter, map[string][]string, error) {
 	positionChoices := map[string][]string{}
 
 	for _, position := range c.Positions {
-		if len(position.Candidates) == 0 {
+		if !position.Eligible.Allows(entry) {
+			if hasPositionFields(r, position) {
+				return nil, nil, errors.Errorf("You aren't eligible to vote for %q.", position.Name)
+			}
+			continue
+		}
+		for _, candidate := range position.Withdrawn {
+			if r.FormValue(position.Name) == candidate || r.FormValue(slugify(position.Name+"-"+candidate)) != "" {
+				return nil, nil, errors.Errorf("%s has withdrawn from %q. Please reload the page and vote again.", candidate, position.Name)
+			}
+		}
+		running := position.Running()
+		if len(running) == 0 {
 			continue
 		}
 
@@ -237,7 +411,7 @@ func validateVoteForm(r *http.Request) (*Voter, map[string][]string, error) {
 				choice: val,
 			})
 		}
-		for _, candidate := range position.Candidates {
+		for _, candidate := range running {
 			if candidate == val {
 				ranks = append(ranks, rank{
 					rank:   0,
@@ -275,44 +449,58 @@ func validateVoteForm(r *http.Request) (*Voter, map[string][]string, error) {
 		positionChoices[position.Name] = choices
 	}
 
-	user := os.Getenv("REMOTE_USER")
-	if len(user) == 0 {
-		return nil, nil, errors.New("missing REMOTE_USER")
+	referendumChoices := map[string]string{}
+	for _, referendum := range c.Referendums {
+		val := r.FormValue(referendum.FieldName())
+		if val == "" {
+			return nil, nil, errors.Errorf("All fields are required. Missing answer to referendum %q.", referendum.Question)
+		}
+		if !referendum.IsChoice(val) {
+			return nil, nil, errors.Errorf("Invalid answer %q to referendum %q.", val, referendum.Question)
+		}
+		referendumChoices[referendum.Question] = val
 	}
 
-	sidsRaw, err := ioutil.ReadFile(c.StudentIDs)
+	sidKey, err := voterKey(keyStudentNumber, sid)
 	if err != nil {
 		return nil, nil, err
 	}
-	sids := strings.Split(strings.TrimSpace(string(sidsRaw)), "\n")
-	found := false
-	for _, sid2 := range sids {
-		if sid == strings.TrimSpace(sid2) {
-			found = true
-			break
-		}
-	}
-	if !found {
-		return nil, nil, errors.Errorf("Invalid student number %q. Make sure you typed it in correctly and that you're a computer science student.", sid)
-	}
-
 	voter := &Voter{
-		Username:      user,
+		Username:      userKey,
 		Name:          name,
-		StudentNumber: sid,
+		StudentNumber: sidKey,
+	}
+	if hashedRoll() {
+		voter.Name = ""
 	}
-	return voter, positionChoices, nil
+	return voter, &Ballot{
+		Positions:   positionChoices,
+		Referendums: referendumChoices,
+	}, nil
 }
 
 func runMigrate(db *gorm.DB) error {
 	db.AutoMigrate(&Voter{})
-	db.AutoMigrate(&Vote{})
-	return nil
+	db.AutoMigrate(&RollEntry{})
+	db.AutoMigrate(&CommitmentRecord{})
+	db.AutoMigrate(&AdminChange{})
+	db.AutoMigrate(&VotingToken{})
+	db.AutoMigrate(&OutboxMessage{})
+	db.AutoMigrate(&Submission{})
+	if err := db.Exec(createBallotsTable).Error; err != nil {
+		return err
+	}
+	return migrateLegacyVotes(db)
 }
 
 type server struct {
-	db  *gorm.DB
-	mux *http.ServeMux
+	db   *gorm.DB
+	mux  *http.ServeMux
+	tmpl *template.Template
+	auth Authenticator
+	// mu guards the parts of the config the admin console changes, which
+	// requests in the standalone server read concurrently.
+	mu sync.RWMutex
 }
 
 func (s *server) Close() error {
@@ -328,22 +516,137 @@ func isAdmin(user string) bool {
 	return false
 }
 
-func setup() (*server, error) {
-	flag.Parse()
+// acceptVote validates and stores the ballot submitted in r, returning it
+// along with the voter's signed receipt.
+func (s *server) acceptVote(r *http.Request) (*Ballot, []byte, error) {
+	if r.Method != http.MethodPost {
+		return nil, nil, errors.New("must use post")
+	}
+	submittedAt := now()
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, err
+	}
+	if err := checkPollOpen(submittedAt, r.FormValue("loaded_at")); err != nil {
+		return nil, nil, err
+	}
+
+	voter, ballot, err := validateVoteForm(s.db, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ballot.Tracker, err = newTracker()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Sign the receipt before storing the ballot so that a voter is
+	// never left without one.
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	receipt, err := newReceipt(ballot, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := signReceipt(key, receipt)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	confirmTo, err := confirmationAddress(s.db, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// We've validated votes, now insert into database.
+
+	tx := s.db.Begin()
+	defer tx.Rollback()
+
+	count := 0
+	if err := tx.Model(&Voter{}).Where("username = ? or student_number = ?", voter.Username, voter.StudentNumber).Count(&count).Error; err != nil {
+		return nil, nil, err
+	}
+	if count >= 1 {
+		return nil, nil, errors.Errorf("This user name or student number has already voted.")
+	}
+
+	if err := tx.Create(&voter).Error; err != nil {
+		return nil, nil, err
+	}
+
+	if token := votingToken(r); token != nil {
+		if err := consumeToken(tx, token.Hash, submittedAt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := insertBallot(tx, ballot); err != nil {
+		return nil, nil, err
+	}
+
+	if key := r.FormValue(idempotencyField); key != "" {
+		if err := storeSubmission(tx, key, csrfIdentity(r), body); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if confirmTo != "" {
+		subject, text := confirmationMail(submittedAt, body)
+		if err := queueMail(tx, MailConfirmation, confirmTo, subject, text); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	positions := map[string][]string{}
+	if err := tx.Commit().Error; err != nil {
+		return nil, nil, err
+	}
+
+	return ballot, body, nil
+}
+
+// validate checks the schedule, tie breaking, positions and referendums.
+func (c Config) validate() error {
+	if _, err := c.Schedule(); err != nil {
+		return err
+	}
+	if err := c.TieBreak.Validate(); err != nil {
+		return err
+	}
 	for _, p := range c.Positions {
-		for _, c := range p.Candidates {
-			positions[c] = append(positions[c], p.Name)
+		if err := p.Validate(); err != nil {
+			return err
 		}
 	}
-	for i, b := range c.Bios {
-		c.Bios[i].Positions = positions[b.Name]
+	for _, r := range c.Referendums {
+		if err := r.Validate(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func setup() (*server, error) {
+	flag.Parse()
+
+	linkBios()
 
 	if len(c.DBPath) == 0 {
 		return nil, errors.Errorf("dbpath empty!")
 	}
+	if len(c.ElectionID) == 0 {
+		return nil, errors.Errorf("electionid empty!")
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
 
 	tmpl := template.New("")
 	tmpl.Funcs(map[string]interface{}{
@@ -377,6 +680,9 @@ func setup() (*server, error) {
 			}
 			return template.HTML(html)
 		},
+		"join": strings.Join,
+		"when": formatScheduleTime,
+		"num":  svgNum,
 		"seq": func(n int) []int {
 			var nums []int
 			for i := 1; i <= n; i++ {
@@ -384,6 +690,9 @@ func setup() (*server, error) {
 			}
 			return nums
 		},
+		"method": func(p Position) Method {
+			return methods[p.MethodName()]
+		},
 		"hasBio": func(candidate string) bool {
 			for _, b := range c.Bios {
 				if b.Name == candidate {
@@ -400,24 +709,7 @@ func setup() (*server, error) {
 	}
 
 	if *index {
-		f, err := os.OpenFile("index.html", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
-		if err != nil {
-			return nil, err
-		}
-		defer f.Close()
-
-		footer, err := writeTemplate(f, "Elections")
-		if err != nil {
-			return nil, err
-		}
-		if err := tmpl.ExecuteTemplate(f, "index.html", nil); err != nil {
-			return nil, err
-		}
-		if _, err := f.Write(footer); err != nil {
-			return nil, err
-		}
-
-		return nil, nil
+		return nil, writeStaticPage("index.html", "Elections", tmpl, nil)
 	}
 
 	// NOTE: this database has to be able to be opened and edited by multiple
@@ -435,91 +727,75 @@ func setup() (*server, error) {
 		return nil, nil
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/vote", handleErr(func(w *TemplateWriter, r *http.Request) error {
-		if r.Method != http.MethodPost {
-			return errors.New("must use post")
-		}
-		if !c.Open {
-			return errors.New("voting is closed")
-		}
-		if err := r.ParseForm(); err != nil {
-			return err
-		}
-
-		voter, positionChoices, err := validateVoteForm(r)
-		if err != nil {
-			return err
-		}
+	if err := loadAdminChanges(db); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, errors.Wrap(err, "after admin changes")
+	}
 
-		// We've validated votes, now insert into database.
+	if *resultsPage {
+		defer db.Close()
+		return nil, publishResults(db, tmpl)
+	}
 
-		tx := db.Begin()
+	if err := auditStartup(); err != nil {
+		return nil, err
+	}
 
-		count := 0
-		if err := tx.Model(&Voter{}).Where("username = ? or student_number = ?", voter.Username, voter.StudentNumber).Count(&count).Error; err != nil {
-			return err
-		}
-		if count >= 1 {
-			return errors.Errorf("This user name or student number has already voted.")
-		}
+	auth, err := newAuthenticator()
+	if err != nil {
+		return nil, err
+	}
 
-		if err := tx.Create(&voter).Error; err != nil {
-			return err
-		}
+	mux := http.NewServeMux()
+	s := &server{
+		mux:  mux,
+		db:   db,
+		tmpl: tmpl,
+		auth: auth,
+	}
 
-		for position, choices := range positionChoices {
-			jsonChoices, err := json.Marshal(choices)
-			if err != nil {
-				return err
-			}
-			if err := tx.Create(&Vote{
-				Position:  position,
-				Candidate: string(jsonChoices),
-			}).Error; err != nil {
+	mux.HandleFunc("/vote", s.tokenOrLogin(s.readConfig(handleErr(func(w *TemplateWriter, r *http.Request) error {
+		// Only record the hashed username if the roll is hashed.
+		var user string
+		if token := votingToken(r); token != nil {
+			user = token.Entry.Username
+		} else {
+			var err error
+			if user, err = voterKey(keyUsername, remoteUser(r)); err != nil {
 				return err
 			}
 		}
-
-		if err := tx.Commit().Error; err != nil {
-			return err
-		}
-
-		// Generate cryptographic receipt for votes.
-		var body bytes.Buffer
-		fmt.Fprintf(&body, "User: %+v\n", voter)
-		fmt.Fprintf(&body, "Time: %s\n", time.Now().String())
-		for k, v := range r.Form {
-			fmt.Fprintf(&body, "- %s: %+v\n", k, v)
-		}
-
-		privKey, err := ioutil.ReadFile(c.PrivateKey)
-		if err != nil {
-			return errors.Wrapf(err, "file %q", c.PrivateKey)
-		}
-		block, _ := pem.Decode(privKey)
-		if block == nil {
-			return errors.New("failed to parse PEM block containing the key")
-		}
-		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		ballot, body, resubmitted, err := s.submitVote(r)
 		if err != nil {
+			audit(AuditVoteRejected, map[string]string{"user": user, "reason": err.Error()})
 			return err
 		}
-		hash := sha1.Sum(body.Bytes())
-		if err != nil {
-			return err
+		if !resubmitted {
+			audit(AuditVoteAccepted, map[string]string{"user": user})
 		}
-		sig, err := key.Sign(rand.Reader, hash[:], crypto.SHA1)
-		if err != nil {
-			return err
-		}
-		body.WriteString("\n")
-		body.WriteString(base64.StdEncoding.EncodeToString(sig))
-		body.WriteString("\n")
 
 		w.Title("Voted")
-		return tmpl.ExecuteTemplate(w, "voted.html", body.String())
-	}))
+		return tmpl.ExecuteTemplate(w, "voted.html", struct {
+			Tracker  string
+			Receipt  string
+			Download template.URL
+		}{
+			Tracker:  ballot.Tracker,
+			Receipt:  string(body),
+			Download: template.URL("data:application/json;base64," + base64.StdEncoding.EncodeToString(body)),
+		})
+	}))))
+
+	mux.HandleFunc("/pubkey", handlePubKey)
+	mux.HandleFunc("/bulletin.json", s.readConfig(s.handleBulletinJSON))
+	mux.HandleFunc("/bulletin", s.readConfig(handleErr(s.handleBulletin)))
+	mux.HandleFunc("/merkle.json", s.readConfig(s.handleCommitment))
+	mux.HandleFunc("/proof", s.readConfig(s.handleProof))
+	if a, ok := auth.(*oidcAuth); ok {
+		mux.HandleFunc(oidcCallbackPath, a.handleCallback)
+	}
 
 	mux.HandleFunc("/debug", debugInfo)
 
@@ -527,17 +803,20 @@ func setup() (*server, error) {
 	mux.Handle("/style.css", static)
 	mux.Handle("/scripts.js", static)
 
-	mux.HandleFunc("/admin", handleErr(func(w *TemplateWriter, r *http.Request) error {
-		user := os.Getenv("REMOTE_USER")
-		if len(user) == 0 {
-			return errors.New("missing REMOTE_USER")
-		}
-
+	mux.HandleFunc("/admin/console", s.login(s.changeConfig(handleErr(s.handleConsole))))
+	mux.HandleFunc("/admin/results", s.login(s.readConfig(handleErr(s.handleResultsPage))))
+	mux.HandleFunc("/admin/turnout", s.login(s.readConfig(handleErr(s.handleTurnout))))
+	mux.HandleFunc("/admin/results.json", s.login(s.readConfig(s.handleResultsJSON)))
+	mux.HandleFunc("/admin/results.csv", s.login(s.readConfig(s.handleResultsCSV)))
+	mux.HandleFunc("/admin/ballots.blt", s.login(s.readConfig(s.handleBLT)))
+	mux.HandleFunc("/admin", s.login(s.readConfig(handleErr(func(w *TemplateWriter, r *http.Request) error {
 		w.Title("Admin")
 
-		if !isAdmin(user) {
-			return errors.New("must be an admin")
+		user, err := adminUser(r)
+		if err != nil {
+			return err
 		}
+		audit(AuditResultsViewed, map[string]string{"user": user})
 
 		var body bytes.Buffer
 		var voters []Voter
@@ -545,103 +824,183 @@ func setup() (*server, error) {
 			return err
 		}
 
-		polls := map[string]*govote.InstantRunoffPoll{}
-		for _, position := range c.Positions {
-			candidates := append(position.Candidates, "Reopen Nominations")
-			if len(candidates) < 2 {
-				candidates = append(candidates, "no one")
-			}
-			poll, err := govote.InstantRunoff.New(candidates)
-			if err != nil {
-				return errors.Wrapf(err, "position %+v; candidates %+v", position, candidates)
-			}
-			polls[position.Name] = &poll
+		ballots, err := loadBallots(db)
+		if err != nil {
+			return err
 		}
-
-		var votes []Vote
-		if err := db.Find(&votes).Error; err != nil {
+		results, err := tallyBallots(ballots)
+		if err != nil {
 			return err
 		}
+		writeResults(&body, results)
 
-		for _, v := range votes {
-			var candidates []string
-			if err := json.Unmarshal([]byte(v.Candidate), &candidates); err != nil {
-				return err
-			}
-			if !polls[v.Position].AddBallot(candidates) {
-				fmt.Fprintf(&body, "error: Failed to AddBallot for vote: %#v\n", v)
-			}
+		ended, err := votingEnded(db)
+		if err != nil {
+			return err
 		}
-
-		fmt.Fprintf(&body, "Results:\n")
-		for _, p := range c.Positions {
-			poll := polls[p.Name]
-			winners, rounds, err := poll.Evaluate()
+		if ended {
+			signed, _, err := loadCommitment(db)
 			if err != nil {
-				fmt.Fprintf(&body, "- %s:\n  error: %+v\n", p.Name, err)
-			} else {
-				fmt.Fprintf(&body, "- %s:\n  Winner: %s\n", p.Name, strings.Join(winners, ","))
-				for i, round := range rounds {
-					fmt.Fprintf(&body, "  - Round %d:\n", i)
-					for _, p := range round {
-						fmt.Fprintf(&body, "    - %+v\n", p)
-					}
-				}
+				return err
 			}
+			var commitment Commitment
+			if err := json.Unmarshal(signed.Commitment, &commitment); err != nil {
+				return err
+			}
+			fmt.Fprintf(&body, "\nMerkle root: %s (%d ballots, signed %s)\n", commitment.Root, commitment.Ballots, commitment.Timestamp)
 		}
 
 		fmt.Fprintf(&body, "\nVoter count: %d\nVoters:\n", len(voters))
 		for _, v := range voters {
-			fmt.Fprintf(&body, "- %s, %s, %s\n", v.StudentNumber, v.Name, v.Username)
+			if hashedRoll() {
+				fmt.Fprintf(&body, "- %s, %s\n", v.StudentNumber, v.Username)
+			} else {
+				fmt.Fprintf(&body, "- %s, %s, %s\n", v.StudentNumber, v.Name, v.Username)
+			}
 		}
 
-		return tmpl.ExecuteTemplate(w, "admin.html", body.String())
-	}))
+		return tmpl.ExecuteTemplate(w, "admin.html", struct {
+			Report    string
+			Positions []Position
+		}{
+			Report:    body.String(),
+			Positions: c.Positions,
+		})
+	}))))
 
-	mux.HandleFunc("/", handleErr(func(w *TemplateWriter, r *http.Request) error {
-		user := os.Getenv("REMOTE_USER")
-		if len(user) == 0 {
+	mux.HandleFunc("/", s.tokenOrLogin(s.readConfig(handleErr(func(w *TemplateWriter, r *http.Request) error {
+		token := votingToken(r)
+		user := remoteUser(r)
+		if len(user) == 0 && token == nil {
 			return errors.New("missing REMOTE_USER")
 		}
+		if token != nil && token.Used {
+			return errTokenUsed
+		}
 
 		w.Title("Elections")
 
-		if !c.Open && !isAdmin(user) {
+		loadedAt := now()
+		state := c.PollState(loadedAt)
+		if state == PollClosed && !isAdmin(user) {
 			return errors.New("voting is closed")
 		}
+		schedule, err := c.Schedule()
+		if err != nil {
+			return err
+		}
+
+		var entry *RollEntry
+		var userKey, tokenValue string
+		if token != nil {
+			entry = token.Entry
+			userKey = entry.Username
+			user = entry.Name
+			tokenValue = r.FormValue("token")
+		} else {
+			if userKey, err = voterKey(keyUsername, user); err != nil {
+				return err
+			}
+			if entry, err = rollEntryForUser(db, user); err != nil {
+				return err
+			}
+		}
 
 		count := 0
-		if err := db.Model(&Voter{}).Where("username = ?", user).Count(&count).Error; err != nil {
+		if err := db.Model(&Voter{}).Where("username = ?", userKey).Count(&count).Error; err != nil {
+			return err
+		}
+
+		config := c
+		config.Positions = eligiblePositions(entry)
+
+		csrf, err := csrfSession(w, r)
+		if err != nil {
+			return err
+		}
+		idempotencyKey, err := randomHex(16)
+		if err != nil {
 			return err
 		}
 
 		return tmpl.ExecuteTemplate(w, "elections.html", struct {
 			Config
-			User  string
-			Voted bool
+			User           string
+			Token          string
+			CSRF           string
+			IdempotencyKey string
+			Voted          bool
+			Poll           string
+			Schedule       Schedule
+			LoadedAt       string
 		}{
-			Config: c,
-			User:   user,
-			Voted:  count > 0,
+			Config:         config,
+			User:           user,
+			Token:          tokenValue,
+			CSRF:           csrf,
+			IdempotencyKey: idempotencyKey,
+			Voted:          count > 0,
+			Poll:           state,
+			Schedule:       schedule,
+			LoadedAt:       loadedAt.UTC().Format(time.RFC3339),
 		})
-	}))
+	}))))
 
-	return &server{
-		mux: mux,
-		db:  db,
-	}, nil
+	return s, nil
+}
+
+// writeStaticPage renders the named template inside the site template to a
+// file of the same name.
+func writeStaticPage(name, title string, tmpl *template.Template, data interface{}) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	footer, err := writeTemplate(f, title)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.ExecuteTemplate(f, name, data); err != nil {
+		return err
+	}
+	if _, err := f.Write(footer); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// loadConfig reads config.yml into c.
+func loadConfig() error {
+	return loadConfigFile("config.yml")
+}
+
+// loadConfigFile reads the config file at path into c.
+func loadConfigFile(path string) error {
+	rawConfig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(rawConfig, &c)
 }
 
 func main() {
 
 	mrand.Seed(time.Now().UnixNano())
 
-	rawConfig, err := ioutil.ReadFile("config.yml")
-	if err != nil {
-		log.Fatal(err)
+	flag.Parse()
+	if *authHeader != "" && *listen == "" {
+		log.Fatal("-authheader can only be used with -listen")
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatalf("%+v", err)
+		}
+		return
 	}
 
-	if err := yaml.Unmarshal(rawConfig, &c); err != nil {
+	if err := loadConfig(); err != nil {
 		log.Fatal(err)
 	}
 
@@ -670,17 +1029,13 @@ func main() {
 	}
 	defer server.Close()
 
-	if err := cgi.Serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		bits := strings.Split(r.URL.Path, "elections.cgi")
-		if len(bits) == 2 {
-			r.URL.Path = bits[1]
-			if r.URL.Path == "" {
-				r.URL.Path = "/"
-			}
+	if *listen != "" {
+		if err := server.listenAndServe(*listen); err != nil {
+			log.Println(err)
 		}
-		log.Printf("%s %s", r.Method, r.URL.Path)
-		server.mux.ServeHTTP(w, r)
-	})); err != nil {
+		return
+	}
+	if err := cgi.Serve(server); err != nil {
 		log.Println(err)
 	}
 }
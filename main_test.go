@@ -12,7 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
-	"sort"
+	"strings"
 	"testing"
 
 	"github.com/Sam-Izdat/govote"
@@ -23,10 +23,13 @@ func setupTest(t *testing.T) (*server, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	c = Config{}
+	c.ElectionID = "test"
 	c.Open = true
 	c.DBPath = filepath.Join(dir, "test.db")
 	c.StudentIDs = filepath.Join(dir, "studentids.txt")
 	c.PrivateKey = filepath.Join(dir, "id_rsa")
+	c.AuditLog = filepath.Join(dir, "audit.log")
 
 	if err := ioutil.WriteFile(c.StudentIDs, []byte(`
 	  12345678
@@ -186,11 +189,15 @@ func TestVote(t *testing.T) {
 		req := httptest.NewRequest("POST", "/vote", nil)
 		req.Form = goodForm()
 
+		addCSRF(t, req)
 		resp := httptest.NewRecorder()
 		s.mux.ServeHTTP(resp, req)
 		if resp.Code != http.StatusOK {
 			t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
 		}
+		if !strings.Contains(resp.Body.String(), "ballot_hash") {
+			t.Fatalf("expected receipt; got %s", resp.Body.Bytes())
+		}
 	}
 
 	var voters []Voter
@@ -218,48 +225,33 @@ func TestVote(t *testing.T) {
 		}
 	}
 
-	var votes []Vote
-	if err := s.db.Find(&votes).Error; err != nil {
+	var records []BallotRecord
+	if err := s.db.Find(&records).Error; err != nil {
 		t.Fatal(err)
 	}
-
-	sort.Slice(votes, func(i, j int) bool {
-		return votes[i].Position < votes[j].Position
-	})
-
-	votesWant := []Vote{
-		{
-			Position:  "Position 1",
-			Candidate: `["Candidate 2"]`,
-		},
-		{
-			Position:  "Position 2",
-			Candidate: `["Candidate 3"]`,
-		},
-		{
-			Position:  "Position 4",
-			Candidate: `["Reopen Nominations"]`,
-		},
-		{
-			Position:  "Position 5",
-			Candidate: `["Candidate 7","Candidate 6"]`,
-		},
-		{
-			Position:  "Position 7",
-			Candidate: `["Reopen Nominations"]`,
-		},
+	if len(records) != 1 {
+		t.Fatalf("got %d ballots; wanted 1", len(records))
 	}
-
-	if len(votesWant) != len(votes) {
-		t.Fatalf("vote mismatch!")
+	if len(records[0].ID) != 32 {
+		t.Errorf("ballot ID %q isn't random", records[0].ID)
 	}
-	for i, voteGot := range votes {
-		voteWant := votesWant[i]
-		voteGot.Model = voteWant.Model
 
-		if !reflect.DeepEqual(voteWant, voteGot) {
-			t.Errorf("%d. %+v != %+v", i, voteWant, voteGot)
-		}
+	ballots, err := loadBallots(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ballots[0].Tracker == "" {
+		t.Fatalf("missing tracker code")
+	}
+	positionsWant := map[string][]string{
+		"Position 1": {"Candidate 2"},
+		"Position 2": {"Candidate 3"},
+		"Position 4": {"Reopen Nominations"},
+		"Position 5": {"Candidate 7", "Candidate 6"},
+		"Position 7": {"Reopen Nominations"},
+	}
+	if !reflect.DeepEqual(ballots[0].Positions, positionsWant) {
+		t.Errorf("got %+v; wanted %+v", ballots[0].Positions, positionsWant)
 	}
 }
 
@@ -295,6 +287,7 @@ func TestVoteDuplicateRank(t *testing.T) {
 		req.Form = goodForm()
 		req.Form.Set(slugify("Position 5-Candidate 6"), "1")
 
+		addCSRF(t, req)
 		resp := httptest.NewRecorder()
 		s.mux.ServeHTTP(resp, req)
 		if resp.Code != http.StatusInternalServerError {
@@ -322,3 +315,115 @@ func TestIRV(t *testing.T) {
 		t.Fatalf("got winners = %+v; wanted %+v", winners, want)
 	}
 }
+
+func TestAdmin(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	c.Positions[4].Seats = 2
+	c.Positions[6].Method = MethodPlurality
+
+	{
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+		}
+	}
+
+	// Not an admin
+	{
+		req := httptest.NewRequest("GET", "/admin", nil)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusInternalServerError {
+			t.Fatalf("expected StatusInternalServerError")
+		}
+	}
+
+	c.Admins = []string{"test"}
+	defer func() { c.Admins = nil }()
+
+	req := httptest.NewRequest("GET", "/admin", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	body := resp.Body.String()
+	for _, want := range []string{
+		"- Position 1:\n  Method: irv\n  Winner: Candidate 2",
+		"- Position 5:\n  Method: stv\n  Seats: 2",
+		"- Position 7:\n  Method: plurality\n  Winner: Reopen Nominations",
+		"Voter count: 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("admin page missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestWithdrawnCandidate(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	vote := func(sid string, form func(url.Values)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		req.Form.Set("student_number", sid)
+		form(req.Form)
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Ranks Candidate 7 then Candidate 6.
+	if resp := vote("12345678", func(url.Values) {}); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	// Only ranks Candidate 7.
+	os.Setenv("REMOTE_USER", "other")
+	defer os.Setenv("REMOTE_USER", "test")
+	if resp := vote("23456789", func(form url.Values) { form.Del(slugify("Position 5-Candidate 6")) }); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	os.Setenv("REMOTE_USER", "test")
+
+	c.Positions[4].Withdrawn = []string{"Candidate 7"}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if body := resp.Body.String(); !strings.Contains(body, "Candidate 6") || strings.Contains(body, "Candidate 7") {
+		t.Errorf("expected withdrawn candidate to be hidden:\n%s", body)
+	}
+
+	c.Admins = []string{"test"}
+	req = httptest.NewRequest("GET", "/admin", nil)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	body := resp.Body.String()
+	if strings.Contains(body, "Failed to AddBallot") {
+		t.Errorf("unexpected error:\n%s", body)
+	}
+	for _, want := range []string{
+		"- Position 5:\n  Withdrawn: Candidate 7 (2 ballots affected, 1 with no remaining choices)\n  Method: irv\n  Winner: Candidate 6",
+		"    - Candidate 6: 1.0000\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("admin page missing %q:\n%s", want, body)
+		}
+	}
+
+	if _, err := c.Positions[4].Tallier(); err != nil {
+		t.Fatal(err)
+	}
+	c.Positions[4].Withdrawn = []string{"Nobody"}
+	if _, err := c.Positions[4].Tallier(); err == nil {
+		t.Errorf("expected error for unknown withdrawn candidate")
+	}
+}
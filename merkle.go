@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// commitmentVersion is the version of the Merkle root commitment format.
+const commitmentVersion = 1
+
+// The Merkle tree follows RFC 9162 (Certificate Transparency): leaves and
+// interior nodes are hashed with different prefixes so one can't be passed
+// off as the other.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+func merkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two less than n.
+func merkleSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// merkleRoot returns the root hash of the tree over leaves.
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		return merkleLeafHash(leaves[0])
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath returns the audit path proving that leaves[index] is in the tree.
+func merklePath(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merklePath(leaves[:k], index), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(leaves[k:], index-k), merkleRoot(leaves[:k]))
+}
+
+// verifyMerklePath checks that path proves leaf is at index in a tree of size
+// with the given root.
+func verifyMerklePath(leaf []byte, index, size int, path [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return errors.Errorf("leaf index %d out of range for %d leaves", index, size)
+	}
+	fn, sn := index, size-1
+	hash := merkleLeafHash(leaf)
+	for _, p := range path {
+		if sn == 0 {
+			return errors.New("inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = merkleNodeHash(p, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNodeHash(hash, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("inclusion proof is too short")
+	}
+	if !bytes.Equal(hash, root) {
+		return errors.Errorf("inclusion proof leads to root %x, not %x", hash, root)
+	}
+	return nil
+}
+
+// ballotLeaves returns the Merkle tree leaves for ballots, which are their
+// ballot hashes in sorted order.
+func ballotLeaves(ballots []*Ballot) ([][]byte, error) {
+	var hashes []string
+	for _, b := range ballots {
+		hash, err := hashBallot(b)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	var leaves [][]byte
+	for _, hash := range hashes {
+		leaf, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves, nil
+}
+
+// Commitment is the Merkle root over every ballot, published when voting
+// closes. Its fields are in alphabetical order so that encoding/json produces
+// the canonical form.
+type Commitment struct {
+	Ballots    int    `json:"ballots"`
+	ElectionID string `json:"election_id"`
+	Root       string `json:"root"`
+	Timestamp  string `json:"timestamp"`
+	Version    int    `json:"version"`
+}
+
+// SignedCommitment is a commitment along with a signature over its canonical
+// form.
+type SignedCommitment struct {
+	Algorithm  string          `json:"algorithm"`
+	Commitment json.RawMessage `json:"commitment"`
+	Signature  string          `json:"signature"`
+}
+
+// CommitmentRecord stores a signed commitment. Signatures are randomized, so
+// the commitment is signed once and stored rather than re-signed on each
+// request.
+type CommitmentRecord struct {
+	ID     uint `gorm:"primary_key"`
+	Root   string
+	Signed string
+}
+
+// TableName implements gorm.tabler.
+func (CommitmentRecord) TableName() string {
+	return "commitments"
+}
+
+// InclusionProof proves that a ballot is included in a published commitment.
+// It can be checked offline with verify-receipt.
+type InclusionProof struct {
+	BallotHash string            `json:"ballot_hash"`
+	Commitment *SignedCommitment `json:"commitment"`
+	LeafIndex  int               `json:"leaf_index"`
+	Path       []string          `json:"path"`
+}
+
+// errVotingNotEnded is returned when committing to the ballots before voting
+// has ended.
+var errVotingNotEnded = errors.New("the ballots are committed to when voting closes")
+
+// loadCommitment returns the signed commitment to the stored ballots and the
+// tree's leaves, signing and storing a new commitment if the ballots have
+// changed since the last one. It returns errVotingNotEnded until voting has
+// ended, so that nothing is committed to before or while voting.
+func loadCommitment(db *gorm.DB) (*SignedCommitment, [][]byte, error) {
+	if ended, err := votingEnded(db); err != nil {
+		return nil, nil, err
+	} else if !ended {
+		return nil, nil, errVotingNotEnded
+	}
+	ballots, err := loadBallots(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaves, err := ballotLeaves(ballots)
+	if err != nil {
+		return nil, nil, err
+	}
+	root := hex.EncodeToString(merkleRoot(leaves))
+
+	var record CommitmentRecord
+	err = db.Where("root = ?", root).Order("id desc").First(&record).Error
+	if err == nil {
+		var signed SignedCommitment
+		if err := json.Unmarshal([]byte(record.Signed), &signed); err != nil {
+			return nil, nil, err
+		}
+		return &signed, leaves, nil
+	} else if !gorm.IsRecordNotFoundError(err) {
+		return nil, nil, err
+	}
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	canonical, err := json.Marshal(Commitment{
+		Ballots:    len(leaves),
+		ElectionID: c.ElectionID,
+		Root:       root,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Version:    commitmentVersion,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := signPSS(key, canonical)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := &SignedCommitment{
+		Algorithm:  receiptAlgorithm,
+		Commitment: canonical,
+		Signature:  sig,
+	}
+	body, err := json.Marshal(signed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.Create(&CommitmentRecord{Root: root, Signed: string(body)}).Error; err != nil {
+		return nil, nil, err
+	}
+	audit(AuditMerkleRoot, map[string]string{"root": root, "ballots": strconv.Itoa(len(leaves))})
+	return signed, leaves, nil
+}
+
+// verifyCommitment checks the signature on a commitment.
+func verifyCommitment(pub *rsa.PublicKey, signed *SignedCommitment) (*Commitment, error) {
+	if signed == nil {
+		return nil, errors.New("missing commitment")
+	}
+	if signed.Algorithm != receiptAlgorithm {
+		return nil, errors.Errorf("unsupported signature algorithm %q", signed.Algorithm)
+	}
+	var commitment Commitment
+	dec := json.NewDecoder(bytes.NewReader(signed.Commitment))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&commitment); err != nil {
+		return nil, errors.Wrap(err, "invalid commitment")
+	}
+	if commitment.Version != commitmentVersion {
+		return nil, errors.Errorf("unsupported commitment version %d", commitment.Version)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, signed.Commitment); err != nil {
+		return nil, err
+	}
+	if err := verifyPSS(pub, compact.Bytes(), signed.Signature); err != nil {
+		return nil, err
+	}
+	return &commitment, nil
+}
+
+// newInclusionProof returns the proof that the ballot with the given hash is
+// included in the commitment.
+func newInclusionProof(signed *SignedCommitment, leaves [][]byte, ballotHash string) (*InclusionProof, error) {
+	leaf, err := hex.DecodeString(ballotHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ballot hash")
+	}
+	index := sort.Search(len(leaves), func(i int) bool {
+		return bytes.Compare(leaves[i], leaf) >= 0
+	})
+	if index == len(leaves) || !bytes.Equal(leaves[index], leaf) {
+		return nil, errors.Errorf("no ballot with hash %s", ballotHash)
+	}
+	proof := &InclusionProof{
+		BallotHash: ballotHash,
+		Commitment: signed,
+		LeafIndex:  index,
+		Path:       []string{},
+	}
+	for _, p := range merklePath(leaves, index) {
+		proof.Path = append(proof.Path, hex.EncodeToString(p))
+	}
+	return proof, nil
+}
+
+// verifyInclusionProof checks that the ballot in receipt is included in the
+// signed commitment in proof.
+func verifyInclusionProof(pub *rsa.PublicKey, receipt *Receipt, proof *InclusionProof) (*Commitment, error) {
+	commitment, err := verifyCommitment(pub, proof.Commitment)
+	if err != nil {
+		return nil, err
+	}
+	if commitment.ElectionID != receipt.ElectionID {
+		return nil, errors.Errorf("commitment is for election %q, not %q", commitment.ElectionID, receipt.ElectionID)
+	}
+	if proof.BallotHash != receipt.BallotHash {
+		return nil, errors.Errorf("proof is for ballot %s, not %s", proof.BallotHash, receipt.BallotHash)
+	}
+	leaf, err := hex.DecodeString(receipt.BallotHash)
+	if err != nil {
+		return nil, err
+	}
+	root, err := hex.DecodeString(commitment.Root)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid root")
+	}
+	var path [][]byte
+	for _, p := range proof.Path {
+		node, err := hex.DecodeString(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proof")
+		}
+		path = append(path, node)
+	}
+	if err := verifyMerklePath(leaf, proof.LeafIndex, commitment.Ballots, path, root); err != nil {
+		return nil, err
+	}
+	return commitment, nil
+}
+
+// handleCommitment serves the signed Merkle root once voting ends.
+func (s *server) handleCommitment(w http.ResponseWriter, r *http.Request) {
+	signed, _, err := loadCommitment(s.db)
+	if err == errVotingNotEnded {
+		http.Error(w, "the Merkle root is published when voting closes", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to load ballots", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, signed)
+}
+
+// handleProof serves the inclusion proof for the ballot_hash query parameter
+// once voting ends.
+func (s *server) handleProof(w http.ResponseWriter, r *http.Request) {
+	signed, leaves, err := loadCommitment(s.db)
+	if err == errVotingNotEnded {
+		http.Error(w, "inclusion proofs are published when voting closes", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to load ballots", http.StatusInternalServerError)
+		return
+	}
+	proof, err := newInclusionProof(signed, leaves, r.FormValue("ballot_hash"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, proof)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMerklePaths(t *testing.T) {
+	var leaves [][]byte
+	for n := 1; n <= 17; n++ {
+		leaf := sha256.Sum256([]byte{byte(n)})
+		leaves = append(leaves, leaf[:])
+		root := merkleRoot(leaves)
+		for i := range leaves {
+			path := merklePath(leaves, i)
+			if err := verifyMerklePath(leaves[i], i, n, path, root); err != nil {
+				t.Fatalf("size %d index %d: %+v", n, i, err)
+			}
+			if n > 1 {
+				if err := verifyMerklePath(leaves[(i+1)%n], i, n, path, root); err == nil {
+					t.Errorf("size %d index %d: proof accepted for wrong leaf", n, i)
+				}
+			}
+		}
+	}
+
+	// RFC 9162 domain separation: a single leaf isn't its own hash.
+	if root := merkleRoot(leaves[:1]); string(root) == string(leaves[0]) {
+		t.Errorf("leaf not hashed")
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(c.StudentIDs, []byte("12345678\n23456789\n34567890\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var receipts [][]byte
+	for i, sid := range []string{"12345678", "23456789", "34567890"} {
+		os.Setenv("REMOTE_USER", fmt.Sprintf("voter%d", i))
+		form := goodForm()
+		form.Set("student_number", sid)
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = form
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+		}
+		match := receiptRegexp.FindStringSubmatch(resp.Body.String())
+		if match == nil {
+			t.Fatalf("missing receipt: %s", resp.Body.Bytes())
+		}
+		receipts = append(receipts, []byte(html.UnescapeString(match[1])))
+	}
+	os.Setenv("REMOTE_USER", "test")
+
+	req := httptest.NewRequest("GET", "/merkle.json", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("expected root to be withheld while voting is open; got %d", resp.Code)
+	}
+
+	c.Open = false
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first *SignedCommitment
+	for i, body := range receipts {
+		receipt, err := verifyReceipt(&key.PublicKey, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/proof?ballot_hash="+receipt.BallotHash, nil)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+		}
+		var proof InclusionProof
+		if err := json.Unmarshal(resp.Body.Bytes(), &proof); err != nil {
+			t.Fatal(err)
+		}
+		commitment, err := verifyInclusionProof(&key.PublicKey, receipt, &proof)
+		if err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if commitment.Ballots != 3 {
+			t.Errorf("commitment covers %d ballots; wanted 3", commitment.Ballots)
+		}
+		// The commitment is only signed once.
+		if first == nil {
+			first = proof.Commitment
+		} else if proof.Commitment.Signature != first.Signature {
+			t.Errorf("commitment re-signed")
+		}
+
+		if i == 0 {
+			dir := filepath.Dir(c.PrivateKey)
+			receiptPath := filepath.Join(dir, "receipt.json")
+			proofPath := filepath.Join(dir, "proof.json")
+			pubKeyPath := filepath.Join(dir, "pubkey.pem")
+			pub, err := encodePublicKey(&key.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(pubKeyPath, pub, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(receiptPath, body, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(proofPath, resp.Body.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := runCommand([]string{"verify-receipt", "-pubkey", pubKeyPath, "-proof", proofPath, receiptPath}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			// A proof for another ballot doesn't verify.
+			other := *receipt
+			other.BallotHash = proof.Path[0]
+			if _, err := verifyInclusionProof(&key.PublicKey, &other, &proof); err == nil {
+				t.Errorf("proof accepted for another ballot")
+			}
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/proof?ballot_hash=00", nil)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected StatusNotFound for unknown ballot; got %d", resp.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// publishResults writes the results to results.html with the site template,
+// for posting once polls close. The page only contains the counts, so errors
+// naming individual ballots are replaced by how many there were.
+func publishResults(db *gorm.DB, tmpl *template.Template) error {
+	if ended, err := votingEnded(db); err != nil {
+		return err
+	} else if !ended {
+		return errors.New("results can only be published once polls are closed")
+	}
+
+	ballots, err := loadBallots(db)
+	if err != nil {
+		return err
+	}
+	results, err := tallyBallots(ballots)
+	if err != nil {
+		return err
+	}
+	page, err := newResultsPage(db, results)
+	if err != nil {
+		return err
+	}
+	page.Problems = len(page.Errors)
+	page.Errors = nil
+
+	signed, _, err := loadCommitment(db)
+	if err != nil {
+		return err
+	}
+	var commitment Commitment
+	if err := json.Unmarshal(signed.Commitment, &commitment); err != nil {
+		return err
+	}
+	page.Root = commitment.Root
+
+	if err := writeStaticPage("results.html", "Election Results", tmpl, page); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadFile("results.html")
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	audit(AuditResultsPublic, map[string]string{
+		"ballots": strconv.Itoa(results.Ballots),
+		"root":    commitment.Root,
+		"sha256":  hex.EncodeToString(sum[:]),
+	})
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPublishResults(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	castVote(t, s, goodForm())
+
+	// results.html is written to the working directory next to
+	// template.html.
+	site, err := ioutil.ReadFile("template.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(c.DBPath)
+	if err := ioutil.WriteFile(filepath.Join(dir, "template.html"), site, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := publishResults(s.db, s.tmpl); err == nil {
+		t.Fatalf("expected error publishing results while polls are open")
+	}
+
+	c.Open = false
+	if err := publishResults(s.db, s.tmpl); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	body, err := ioutil.ReadFile("results.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(body)
+	for _, want := range []string{
+		"<title>Election Results | UBC CSSS",
+		"1 ballots were cast in election <code>test</code>",
+		"Winner: Candidate 2",
+		"The ballots counted have the Merkle root <code>",
+		"</html>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("results.html missing %q:\n%s", want, page)
+		}
+	}
+	for _, voter := range []string{"Voter", "12345678"} {
+		if strings.Contains(page, voter) {
+			t.Errorf("results.html contains voter details %q", voter)
+		}
+	}
+
+	_, records := readAuditRecords(t)
+	if last := records[len(records)-1]; last.Event != AuditResultsPublic || last.Details["sha256"] == "" {
+		t.Errorf("expected results to be audited; got %+v", last)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// receiptVersion is the version of the receipt format.
+	receiptVersion = 1
+	// receiptAlgorithm is the signature scheme used to sign receipts.
+	receiptAlgorithm = "RSA-PSS-SHA256"
+)
+
+// Receipt is the record of a ballot given to a voter. Its fields are in
+// alphabetical order so that encoding/json produces the canonical form, which
+// is compact JSON with sorted keys.
+type Receipt struct {
+	Ballot     *Ballot `json:"ballot"`
+	BallotHash string  `json:"ballot_hash"`
+	ElectionID string  `json:"election_id"`
+	Timestamp  string  `json:"timestamp"`
+	Version    int     `json:"version"`
+}
+
+// SignedReceipt is a receipt along with a signature over its canonical form.
+type SignedReceipt struct {
+	Algorithm string          `json:"algorithm"`
+	Receipt   json.RawMessage `json:"receipt"`
+	Signature string          `json:"signature"`
+}
+
+// hashBallot returns the hex encoded SHA-256 hash of the canonical JSON
+// encoding of a ballot.
+func hashBallot(ballot *Ballot) (string, error) {
+	body, err := json.Marshal(ballot)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// newReceipt creates a receipt for a ballot cast now.
+func newReceipt(ballot *Ballot, now time.Time) (*Receipt, error) {
+	hash, err := hashBallot(ballot)
+	if err != nil {
+		return nil, err
+	}
+	return &Receipt{
+		Ballot:     ballot,
+		BallotHash: hash,
+		ElectionID: c.ElectionID,
+		Timestamp:  now.UTC().Format(time.RFC3339),
+		Version:    receiptVersion,
+	}, nil
+}
+
+// signReceipt signs the canonical form of a receipt.
+func signReceipt(key *rsa.PrivateKey, receipt *Receipt) (*SignedReceipt, error) {
+	canonical, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signPSS(key, canonical)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedReceipt{
+		Algorithm: receiptAlgorithm,
+		Receipt:   canonical,
+		Signature: sig,
+	}, nil
+}
+
+// signPSS returns the base64 encoded RSA-PSS SHA-256 signature of msg.
+func signPSS(key *rsa.PrivateKey, msg []byte) (string, error) {
+	hash := sha256.Sum256(msg)
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, hash[:], &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyPSS checks a signature produced by signPSS.
+func verifyPSS(pub *rsa.PublicKey, msg []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	hash := sha256.Sum256(msg)
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, hash[:], sig, &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+	}); err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	return nil
+}
+
+// verifyReceipt checks that a signed receipt is in canonical form, matches its
+// ballot and was signed by key.
+func verifyReceipt(pub *rsa.PublicKey, body []byte) (*Receipt, error) {
+	var signed SignedReceipt
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, errors.Wrap(err, "invalid receipt")
+	}
+	if signed.Algorithm != receiptAlgorithm {
+		return nil, errors.Errorf("unsupported signature algorithm %q", signed.Algorithm)
+	}
+
+	var receipt Receipt
+	dec := json.NewDecoder(bytes.NewReader(signed.Receipt))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&receipt); err != nil {
+		return nil, errors.Wrap(err, "invalid receipt")
+	}
+	if receipt.Version != receiptVersion {
+		return nil, errors.Errorf("unsupported receipt version %d", receipt.Version)
+	}
+	if _, err := time.Parse(time.RFC3339, receipt.Timestamp); err != nil {
+		return nil, errors.Wrap(err, "invalid timestamp")
+	}
+	canonical, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, signed.Receipt); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(canonical, compact.Bytes()) {
+		return nil, errors.New("receipt is not in canonical form")
+	}
+
+	hash, err := hashBallot(receipt.Ballot)
+	if err != nil {
+		return nil, err
+	}
+	if hash != receipt.BallotHash {
+		return nil, errors.Errorf("ballot hash %s does not match ballot (%s)", receipt.BallotHash, hash)
+	}
+
+	if err := verifyPSS(pub, canonical, signed.Signature); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS#1 or PKCS#8 RSA private key.
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file %q", path)
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("file %q: not an RSA private key", path)
+	}
+	return key, nil
+}
+
+// loadPublicKey reads a PEM encoded PKIX RSA public key.
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file %q", path)
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("file %q: not an RSA public key", path)
+	}
+	return pub, nil
+}
+
+// encodePublicKey returns the PEM encoded PKIX form of a public key.
+func encodePublicKey(pub *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
+// handlePubKey serves the public key that receipts are signed with.
+func handlePubKey(w http.ResponseWriter, r *http.Request) {
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to load key", http.StatusInternalServerError)
+		return
+	}
+	body, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		log.Printf("Error: %+v", err)
+		http.Error(w, "failed to encode key", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(body)
+}
+
+// runVerifyReceipt implements the verify-receipt command.
+func runVerifyReceipt(args []string) error {
+	fs := flag.NewFlagSet("verify-receipt", flag.ExitOnError)
+	pubKey := fs.String("pubkey", "", "the public key to verify against, as served at /pubkey (defaults to the key in config.yml)")
+	proofFile := fs.String("proof", "", "an inclusion proof, as served at /proof, to check the ballot against the published Merkle root")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections verify-receipt [-pubkey pubkey.pem] [-proof proof.json] <receipt.json>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one receipt file")
+	}
+
+	var pub *rsa.PublicKey
+	if *pubKey != "" {
+		var err error
+		pub, err = loadPublicKey(*pubKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := loadConfig(); err != nil {
+			return err
+		}
+		key, err := loadPrivateKey(c.PrivateKey)
+		if err != nil {
+			return err
+		}
+		pub = &key.PublicKey
+	}
+
+	body, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	receipt, err := verifyReceipt(pub, body)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Valid receipt for election %q cast at %s.\nBallot hash: %s\n", receipt.ElectionID, receipt.Timestamp, receipt.BallotHash)
+
+	if *proofFile != "" {
+		body, err := ioutil.ReadFile(*proofFile)
+		if err != nil {
+			return err
+		}
+		var proof InclusionProof
+		if err := json.Unmarshal(body, &proof); err != nil {
+			return errors.Wrap(err, "invalid proof")
+		}
+		commitment, err := verifyInclusionProof(pub, receipt, &proof)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Ballot is included in Merkle root %s of %d ballots.\n", commitment.Root, commitment.Ballots)
+	}
+	return nil
+}
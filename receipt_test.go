@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceiptSignVerify(t *testing.T) {
+	_, cleanup := setupTest(t)
+	defer cleanup()
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ballot := &Ballot{
+		Positions:   map[string][]string{"Position 1": {"Candidate 2", "Candidate 1"}},
+		Referendums: map[string]string{},
+	}
+	receipt, err := newReceipt(ballot, time.Date(2022, 3, 28, 9, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signReceipt(key, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ballot":{"positions":{"Position 1":["Candidate 2","Candidate 1"]},"referendums":{},"tracker":""},"ballot_hash":"` +
+		receipt.BallotHash + `","election_id":"test","timestamp":"2022-03-28T09:00:00Z","version":1}`
+	if string(signed.Receipt) != want {
+		t.Fatalf("got canonical receipt %s; wanted %s", signed.Receipt, want)
+	}
+
+	body, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyReceipt(&key.PublicKey, body); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, tamper := range []struct{ old, new string }{
+		{`"Candidate 2",`, `"Candidate 1",`},
+		{`"election_id": "test"`, `"election_id": "other"`},
+		{`"version": 1`, `"version": 1, "extra": true`},
+		{`"algorithm": "RSA-PSS-SHA256"`, `"algorithm": "RSA-SHA1"`},
+	} {
+		tampered := strings.Replace(string(body), tamper.old, tamper.new, 1)
+		if tampered == string(body) {
+			t.Fatalf("tamper %q not applied", tamper.old)
+		}
+		if _, err := verifyReceipt(&key.PublicKey, []byte(tampered)); err == nil {
+			t.Errorf("expected error after replacing %q with %q", tamper.old, tamper.new)
+		}
+	}
+}
+
+func TestVerifyReceiptCommand(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "/pubkey", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "BEGIN PUBLIC KEY") {
+		t.Fatalf("bad /pubkey response %d: %s", resp.Code, resp.Body.Bytes())
+	}
+	dir := filepath.Dir(c.PrivateKey)
+	pubKeyPath := filepath.Join(dir, "pubkey.pem")
+	if err := ioutil.WriteFile(pubKeyPath, resp.Body.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := newReceipt(&Ballot{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signReceipt(key, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptPath := filepath.Join(dir, "receipt.json")
+	if err := ioutil.WriteFile(receiptPath, body, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCommand([]string{"verify-receipt", "-pubkey", pubKeyPath, receiptPath}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
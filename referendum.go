@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Referendum answers with special meaning when counting.
+const (
+	ReferendumYes     = "Yes"
+	ReferendumNo      = "No"
+	ReferendumAbstain = "Abstain"
+)
+
+// Referendum is a question put to voters, such as a constitutional amendment
+// or a fee referendum.
+type Referendum struct {
+	Question string
+	Desc     string
+	// Options are the answers voters can choose from. They default to Yes, No
+	// and Abstain and must include Yes.
+	Options []string
+	// Quorum is the minimum number of ballots, including abstentions, that
+	// must answer the question for the result to be binding.
+	Quorum int
+	// Threshold is the fraction of valid (non-abstaining) votes that must be
+	// Yes for the referendum to pass, e.g. "2/3". It defaults to "1/2".
+	Threshold string
+}
+
+// FieldName is the name of the form field used to answer the question.
+func (r Referendum) FieldName() string {
+	return slugify("referendum-" + r.Question)
+}
+
+// Choices returns the options voters can choose from.
+func (r Referendum) Choices() []string {
+	if len(r.Options) == 0 {
+		return []string{ReferendumYes, ReferendumNo, ReferendumAbstain}
+	}
+	return r.Options
+}
+
+// ThresholdText returns the threshold as a fraction.
+func (r Referendum) ThresholdText() string {
+	if r.Threshold == "" {
+		return "1/2"
+	}
+	return r.Threshold
+}
+
+func (r Referendum) threshold() (int, int, error) {
+	parts := strings.Split(r.ThresholdText(), "/")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("referendum %q: threshold %q must be a fraction like 2/3", r.Question, r.Threshold)
+	}
+	num, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "referendum %q: threshold", r.Question)
+	}
+	den, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "referendum %q: threshold", r.Question)
+	}
+	if num <= 0 || den <= 0 || num > den {
+		return 0, 0, errors.Errorf("referendum %q: threshold %q must be between 0 and 1", r.Question, r.Threshold)
+	}
+	return num, den, nil
+}
+
+// Validate checks the referendum configuration.
+func (r Referendum) Validate() error {
+	if strings.TrimSpace(r.Question) == "" {
+		return errors.New("referendum missing question")
+	}
+	if _, _, err := r.threshold(); err != nil {
+		return err
+	}
+	if !r.IsChoice(ReferendumYes) {
+		return errors.Errorf("referendum %q: options must include %q", r.Question, ReferendumYes)
+	}
+	return nil
+}
+
+// IsChoice reports whether choice is one of the options.
+func (r Referendum) IsChoice(choice string) bool {
+	for _, o := range r.Choices() {
+		if o == choice {
+			return true
+		}
+	}
+	return false
+}
+
+// ReferendumResult is the outcome of a referendum.
+type ReferendumResult struct {
+	Referendum `json:"-"`
+	Counts     map[string]int `json:"counts"`
+	// Ballots is the number of ballots answering the question.
+	Ballots int `json:"ballots"`
+	// Valid is the number of ballots that did not abstain.
+	Valid     int  `json:"valid"`
+	QuorumMet bool `json:"quorum_met"`
+	Passed    bool `json:"passed"`
+}
+
+// Tally counts answers to the referendum. It passes if the quorum is met, the
+// Yes votes make up at least the threshold of valid votes, and there are more
+// Yes votes than any other valid votes combined.
+func (r Referendum) Tally(choices []string) (*ReferendumResult, error) {
+	num, den, err := r.threshold()
+	if err != nil {
+		return nil, err
+	}
+	res := &ReferendumResult{
+		Referendum: r,
+		Counts:     map[string]int{},
+	}
+	for _, choice := range choices {
+		if !r.IsChoice(choice) {
+			return nil, errors.Errorf("referendum %q: invalid choice %q", r.Question, choice)
+		}
+		res.Counts[choice]++
+		res.Ballots++
+		if choice != ReferendumAbstain {
+			res.Valid++
+		}
+	}
+	yes := res.Counts[ReferendumYes]
+	res.QuorumMet = res.Ballots >= r.Quorum
+	res.Passed = res.QuorumMet && yes*den >= num*res.Valid && yes*2 > res.Valid
+	return res, nil
+}
+
+// writeReferendumResult writes a human readable report of a referendum.
+func writeReferendumResult(w io.Writer, res *ReferendumResult) {
+	for _, choice := range res.Choices() {
+		fmt.Fprintf(w, "  - %s: %d\n", choice, res.Counts[choice])
+	}
+	fmt.Fprintf(w, "  Ballots: %d (quorum %d)\n", res.Ballots, res.Quorum)
+	if res.Valid > 0 {
+		fmt.Fprintf(w, "  Yes: %.2f%% of %d valid votes (threshold %s)\n",
+			100*float64(res.Counts[ReferendumYes])/float64(res.Valid), res.Valid, res.ThresholdText())
+	}
+	switch {
+	case !res.QuorumMet:
+		fmt.Fprintf(w, "  Result: FAILED (quorum not met)\n")
+	case res.Passed:
+		fmt.Fprintf(w, "  Result: PASSED\n")
+	default:
+		fmt.Fprintf(w, "  Result: FAILED\n")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReferendumTally(t *testing.T) {
+	repeat := func(choice string, n int) []string {
+		var out []string
+		for i := 0; i < n; i++ {
+			out = append(out, choice)
+		}
+		return out
+	}
+	join := func(lists ...[]string) []string {
+		var out []string
+		for _, l := range lists {
+			out = append(out, l...)
+		}
+		return out
+	}
+
+	cases := []struct {
+		desc       string
+		referendum Referendum
+		choices    []string
+		quorumMet  bool
+		passed     bool
+	}{
+		{
+			desc:       "simple majority",
+			referendum: Referendum{Question: "Q"},
+			choices:    join(repeat("Yes", 3), repeat("No", 2), repeat("Abstain", 10)),
+			quorumMet:  true,
+			passed:     true,
+		},
+		{
+			desc:       "tie fails",
+			referendum: Referendum{Question: "Q"},
+			choices:    join(repeat("Yes", 2), repeat("No", 2)),
+			quorumMet:  true,
+			passed:     false,
+		},
+		{
+			desc:       "exactly two thirds",
+			referendum: Referendum{Question: "Q", Threshold: "2/3"},
+			choices:    join(repeat("Yes", 4), repeat("No", 2)),
+			quorumMet:  true,
+			passed:     true,
+		},
+		{
+			desc:       "short of two thirds",
+			referendum: Referendum{Question: "Q", Threshold: "2/3"},
+			choices:    join(repeat("Yes", 5), repeat("No", 3)),
+			quorumMet:  true,
+			passed:     false,
+		},
+		{
+			desc:       "quorum counts abstentions",
+			referendum: Referendum{Question: "Q", Quorum: 5},
+			choices:    join(repeat("Yes", 1), repeat("Abstain", 4)),
+			quorumMet:  true,
+			passed:     true,
+		},
+		{
+			desc:       "quorum not met",
+			referendum: Referendum{Question: "Q", Quorum: 5},
+			choices:    repeat("Yes", 4),
+			quorumMet:  false,
+			passed:     false,
+		},
+	}
+	for _, tc := range cases {
+		res, err := tc.referendum.Tally(tc.choices)
+		if err != nil {
+			t.Fatalf("%s: %+v", tc.desc, err)
+		}
+		if res.QuorumMet != tc.quorumMet || res.Passed != tc.passed {
+			t.Errorf("%s: got quorum met %v passed %v; wanted %v %v", tc.desc, res.QuorumMet, res.Passed, tc.quorumMet, tc.passed)
+		}
+	}
+
+	if _, err := (Referendum{Question: "Q"}).Tally([]string{"Maybe"}); err == nil {
+		t.Error("expected error for invalid choice")
+	}
+}
+
+func TestReferendumValidate(t *testing.T) {
+	for _, r := range []Referendum{
+		{},
+		{Question: "Q", Threshold: "two thirds"},
+		{Question: "Q", Threshold: "3/2"},
+		{Question: "Q", Options: []string{"For", "Against"}},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("expected error for %+v", r)
+		}
+	}
+	if err := (Referendum{Question: "Q", Threshold: "2/3"}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVoteReferendum(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	c.Referendums = []Referendum{
+		{Question: "Amend the constitution?", Threshold: "2/3"},
+	}
+	field := c.Referendums[0].FieldName()
+
+	// Missing answer
+	{
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusInternalServerError {
+			t.Fatalf("expected StatusInternalServerError")
+		}
+	}
+
+	{
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		req.Form.Set(field, "Yes")
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+		}
+	}
+
+	ballots, err := loadBallots(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ballots) != 1 {
+		t.Fatalf("got %d ballots; wanted 1", len(ballots))
+	}
+	got := ballots[0].Referendums
+	want := map[string]string{"Amend the constitution?": "Yes"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; wanted %+v", got, want)
+	}
+
+	c.Admins = []string{"test"}
+	req := httptest.NewRequest("GET", "/admin", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if !strings.Contains(resp.Body.String(), "- Amend the constitution?:\n  - Yes: 1\n  - No: 0\n  - Abstain: 0\n  Ballots: 1 (quorum 0)") ||
+		!strings.Contains(resp.Body.String(), "Result: PASSED") {
+		t.Errorf("admin page missing referendum result:\n%s", resp.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if !strings.Contains(resp.Body.String(), `name="`+field+`"`) {
+		t.Errorf("ballot missing referendum field %q", field)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// PositionResults is the count of a single position.
+type PositionResults struct {
+	Position string `json:"position"`
+	// Ballots is the number of ballots counted for the position.
+	Ballots   int      `json:"ballots"`
+	Withdrawn []string `json:"withdrawn,omitempty"`
+	// WithdrawnBallots is the number of ballots ranking a withdrawn
+	// candidate, and UncountedBallots is how many of them had no other
+	// choices left.
+	WithdrawnBallots int     `json:"withdrawn_ballots,omitempty"`
+	UncountedBallots int     `json:"uncounted_ballots,omitempty"`
+	Result           *Result `json:"result,omitempty"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// ReferendumOutcome is the count of a single referendum.
+type ReferendumOutcome struct {
+	Question  string            `json:"question"`
+	Threshold string            `json:"threshold"`
+	Quorum    int               `json:"quorum"`
+	Result    *ReferendumResult `json:"result,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// Results is the outcome of counting every position and referendum.
+type Results struct {
+	ElectionID string `json:"election_id"`
+	// Ballots is the number of ballots cast.
+	Ballots     int                 `json:"ballots"`
+	Positions   []PositionResults   `json:"positions"`
+	Referendums []ReferendumOutcome `json:"referendums,omitempty"`
+	// Errors describes ballots, or parts of them, that couldn't be counted.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// tallyBallots counts the ballots for each configured position and
+// referendum.
+func tallyBallots(ballots []*Ballot) (*Results, error) {
+	results := &Results{
+		ElectionID: c.ElectionID,
+		Ballots:    len(ballots),
+	}
+
+	talliers := map[string]Tallier{}
+	positions := map[string]*PositionResults{}
+	for _, p := range c.Positions {
+		tallier, err := p.Tallier()
+		if err != nil {
+			return nil, err
+		}
+		talliers[p.Name] = tallier
+		results.Positions = append(results.Positions, PositionResults{
+			Position:  p.Name,
+			Withdrawn: p.Withdrawn,
+		})
+	}
+	for i, p := range c.Positions {
+		positions[p.Name] = &results.Positions[i]
+	}
+
+	referendumChoices := map[string][]string{}
+	for _, b := range ballots {
+		for _, p := range c.Positions {
+			candidates, ok := b.Positions[p.Name]
+			if !ok {
+				continue
+			}
+			res := positions[p.Name]
+			candidates, withdrawn := p.skipWithdrawn(candidates)
+			if withdrawn {
+				res.WithdrawnBallots++
+				if len(candidates) == 0 {
+					res.UncountedBallots++
+					continue
+				}
+			}
+			if err := talliers[p.Name].AddBallot(candidates); err != nil {
+				results.Errors = append(results.Errors, fmt.Sprintf("Failed to AddBallot for ballot %s: %s", b.Tracker, err))
+				continue
+			}
+			res.Ballots++
+		}
+		for position := range b.Positions {
+			if _, ok := positions[position]; !ok {
+				results.Errors = append(results.Errors, fmt.Sprintf("Unknown position %q on ballot %s", position, b.Tracker))
+			}
+		}
+		for question, choice := range b.Referendums {
+			referendumChoices[question] = append(referendumChoices[question], choice)
+		}
+	}
+
+	for i, p := range c.Positions {
+		res, err := talliers[p.Name].Evaluate()
+		if err != nil {
+			results.Positions[i].Error = err.Error()
+			continue
+		}
+		results.Positions[i].Result = res
+	}
+
+	for _, referendum := range c.Referendums {
+		outcome := ReferendumOutcome{
+			Question:  referendum.Question,
+			Threshold: referendum.ThresholdText(),
+			Quorum:    referendum.Quorum,
+		}
+		res, err := referendum.Tally(referendumChoices[referendum.Question])
+		if err != nil {
+			outcome.Error = err.Error()
+		} else {
+			outcome.Result = res
+		}
+		results.Referendums = append(results.Referendums, outcome)
+	}
+	return results, nil
+}
+
+// writeResults writes a human readable report of the results.
+func writeResults(w io.Writer, results *Results) {
+	for _, err := range results.Errors {
+		fmt.Fprintf(w, "error: %s\n", err)
+	}
+
+	fmt.Fprintf(w, "Results:\n")
+	for _, p := range results.Positions {
+		fmt.Fprintf(w, "- %s:\n", p.Position)
+		if p.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", p.Error)
+			continue
+		}
+		if len(p.Withdrawn) > 0 {
+			fmt.Fprintf(w, "  Withdrawn: %s (%d ballots affected, %d with no remaining choices)\n",
+				strings.Join(p.Withdrawn, ","), p.WithdrawnBallots, p.UncountedBallots)
+		}
+		writeResult(w, p.Result)
+	}
+
+	if len(results.Referendums) > 0 {
+		fmt.Fprintf(w, "\nReferendums:\n")
+		for _, r := range results.Referendums {
+			fmt.Fprintf(w, "- %s:\n", r.Question)
+			if r.Error != "" {
+				fmt.Fprintf(w, "  error: %s\n", r.Error)
+				continue
+			}
+			writeReferendumResult(w, r.Result)
+		}
+	}
+}
+
+// loadBulletinBallots reads the ballots from a bulletin board export, as
+// served at /bulletin.json, checking each ballot against its hash and
+// applying the withdrawals it lists to c.
+func loadBulletinBallots(path string) ([]*Ballot, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bulletin Bulletin
+	if err := json.Unmarshal(body, &bulletin); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	if bulletin.ElectionID != c.ElectionID {
+		return nil, errors.Errorf("%s is for election %q, not %q", path, bulletin.ElectionID, c.ElectionID)
+	}
+	var ballots []*Ballot
+	for _, entry := range bulletin.Ballots {
+		if entry.Ballot == nil {
+			return nil, errors.Errorf("%s: missing ballot for hash %s", path, entry.BallotHash)
+		}
+		hash, err := hashBallot(entry.Ballot)
+		if err != nil {
+			return nil, err
+		}
+		if hash != entry.BallotHash {
+			return nil, errors.Errorf("%s: ballot %s doesn't match its hash %s", path, entry.Ballot.Tracker, entry.BallotHash)
+		}
+		ballots = append(ballots, entry.Ballot)
+	}
+	if err := applyBulletinWithdrawals(bulletin.Withdrawn); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	return ballots, nil
+}
+
+// applyBulletinWithdrawals adds the withdrawals listed on the bulletin board
+// to c, so that the count matches the election's even if config.yml doesn't
+// include withdrawals made from the admin console.
+func applyBulletinWithdrawals(withdrawn map[string][]string) error {
+	positions := append([]Position(nil), c.Positions...)
+	for name, candidates := range withdrawn {
+		i, err := c.findPosition(name)
+		if err != nil {
+			return err
+		}
+		p := positions[i]
+		p.Withdrawn = append([]string(nil), p.Withdrawn...)
+		for _, candidate := range candidates {
+			listed := false
+			for _, name := range p.Withdrawn {
+				listed = listed || name == candidate
+			}
+			if !listed {
+				p.Withdrawn = append(p.Withdrawn, candidate)
+			}
+		}
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		positions[i] = p
+	}
+	c.Positions = positions
+	return nil
+}
+
+// loadDatabaseBallots reads the ballots from a copy of the database, applying
+// any changes made from the admin console to c.
+func loadDatabaseBallots(path string) ([]*Ballot, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to database")
+	}
+	defer db.Close()
+	if err := loadAdminChanges(db); err != nil {
+		return nil, err
+	}
+	return loadBallots(db)
+}
+
+func runTally(args []string) error {
+	fs := flag.NewFlagSet("tally", flag.ExitOnError)
+	config := fs.String("config", "config.yml", "the election's config file, for its positions and counting rules")
+	asJSON := fs.Bool("json", false, "print the results as JSON, as served at /admin/results.json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections tally [-config config.yml] [-json] [elections.db|bulletin.json]\n\n"+
+			"Counts the ballots in a copy of the database (defaults to dbpath in the config)\n"+
+			"or a bulletin board export, as served at /bulletin.json.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one ballot file")
+	}
+
+	if err := loadConfigFile(*config); err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	path := fs.Arg(0)
+	if path == "" {
+		path = c.DBPath
+	}
+	var ballots []*Ballot
+	var err error
+	if strings.HasSuffix(path, ".json") {
+		ballots, err = loadBulletinBallots(path)
+	} else {
+		ballots, err = loadDatabaseBallots(path)
+	}
+	if err != nil {
+		return err
+	}
+	// Withdrawals and console changes made since the config was checked
+	// must be valid too.
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	results, err := tallyBallots(ballots)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	writeResults(os.Stdout, results)
+	fmt.Printf("\nBallots: %d\n", results.Ballots)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestTallyCommand(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	castVote(t, s, goodForm())
+	c.Admins = []string{"test"}
+	if err := s.makeAdminChange(AdminChange{Action: AdminWithdrawCandidate, Position: "Position 5", Candidate: "Candidate 7", User: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Dir(c.DBPath)
+	bulletin, err := loadBulletin(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(bulletin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulletinPath := filepath.Join(dir, "bulletin.json")
+	if err := ioutil.WriteFile(bulletinPath, body, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recount with the config as it was before the withdrawal, as a
+	// scrutineer would from config.yml.
+	c.Positions[4].Withdrawn = nil
+	config, err := yaml.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configPath, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fromBulletin, err := loadBulletinBallots(bulletinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Positions[4].Withdrawn; !reflect.DeepEqual(got, []string{"Candidate 7"}) {
+		t.Fatalf("expected withdrawal to be loaded from the bulletin board; got %v", got)
+	}
+	bulletinResults, err := tallyBallots(fromBulletin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Positions[4].Withdrawn = nil
+	fromDB, err := loadDatabaseBallots(c.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromBulletin, fromDB) || len(fromDB) != 1 {
+		t.Errorf("ballots differ: %+v and %+v", fromBulletin, fromDB)
+	}
+	if got := c.Positions[4].Withdrawn; !reflect.DeepEqual(got, []string{"Candidate 7"}) {
+		t.Errorf("expected withdrawal to be loaded from the database; got %v", got)
+	}
+	dbResults, err := tallyBallots(fromDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bulletinResults, dbResults) {
+		t.Errorf("counts differ:\nbulletin board: %+v\ndatabase: %+v", bulletinResults, dbResults)
+	}
+	c.Positions[4].Withdrawn = nil
+	if ignored, err := tallyBallots(fromDB); err != nil || reflect.DeepEqual(ignored, dbResults) {
+		t.Errorf("expected the withdrawal to change the count; got %+v, %v", ignored, err)
+	}
+
+	for _, path := range []string{c.DBPath, bulletinPath} {
+		if err := runCommand([]string{"tally", "-config", configPath, path}); err != nil {
+			t.Fatalf("%s: %+v", path, err)
+		}
+		if err := runCommand([]string{"tally", "-config", configPath, "-json", path}); err != nil {
+			t.Fatalf("%s: %+v", path, err)
+		}
+	}
+
+	// A config that the server would refuse can't be used to count either.
+	c.TieBreak.Rules = []string{"backward"}
+	invalid, err := yaml.Marshal(c)
+	c.TieBreak.Rules = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configPath, invalid, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand([]string{"tally", "-config", configPath, bulletinPath}); err == nil || !strings.Contains(err.Error(), `unknown rule "backward"`) {
+		t.Errorf("expected invalid config to be rejected; got %v", err)
+	}
+
+	tampered := strings.Replace(string(body), "Candidate 7", "Candidate 8", 1)
+	if err := ioutil.WriteFile(bulletinPath, []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBulletinBallots(bulletinPath); err == nil || !strings.Contains(err.Error(), "doesn't match its hash") {
+		t.Errorf("expected tampered ballot to be rejected; got %v", err)
+	}
+
+	c.ElectionID = "other"
+	if _, err := loadBulletinBallots(bulletinPath); err == nil {
+		t.Errorf("expected error for wrong election")
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// RollEntry is an eligible voter on the voter roll.
+type RollEntry struct {
+	StudentNumber string `gorm:"primary_key" json:"student_number"`
+	// Username is the voter's CWL username, as given in REMOTE_USER.
+	Username string `sql:"index" json:"username"`
+	Name     string `json:"name"`
+	Program  string `json:"program"`
+	Year     int    `json:"year"`
+	// Class is the voter's eligibility class, e.g. "member".
+	Class string `json:"class"`
+	// Email is where invitations and confirmations are sent, if set.
+	Email string `json:"email"`
+}
+
+// TableName implements gorm.tabler.
+func (RollEntry) TableName() string {
+	return "roll"
+}
+
+// Kinds of voter identifiers, used to separate their hashes.
+const (
+	keyStudentNumber = "student_number"
+	keyUsername      = "username"
+)
+
+// minSecretLength is the minimum length of the roll and session secrets in
+// bytes.
+const minSecretLength = 16
+
+var hashedKeyRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// hashedRoll reports whether voter identifiers are stored as keyed hashes.
+func hashedRoll() bool {
+	return c.RollSecret != ""
+}
+
+// loadRollSecret reads the secret key used to hash voter identifiers.
+func loadRollSecret(path string) ([]byte, error) {
+	return loadSecret(path, "roll secret")
+}
+
+// loadSecret reads a secret key from a file.
+func loadSecret(path, name string) ([]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file %q", path)
+	}
+	secret := bytes.TrimSpace(body)
+	if len(secret) < minSecretLength {
+		return nil, errors.Errorf("file %q: %s must be at least %d bytes", path, name, minSecretLength)
+	}
+	return secret, nil
+}
+
+// hashVoterKey returns the HMAC-SHA256 of a voter identifier.
+func hashVoterKey(secret []byte, kind, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s:%s", kind, normalizeVoterKey(kind, value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func normalizeVoterKey(kind, value string) string {
+	value = strings.TrimSpace(value)
+	if kind == keyUsername {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// voterKey returns the identifier stored for a student number or username.
+// If rollsecret is set this is a keyed hash, so the raw value is never stored.
+func voterKey(kind, value string) (string, error) {
+	if !hashedRoll() {
+		return normalizeVoterKey(kind, value), nil
+	}
+	secret, err := loadRollSecret(c.RollSecret)
+	if err != nil {
+		return "", err
+	}
+	return hashVoterKey(secret, kind, value), nil
+}
+
+// hashRoll replaces the identifiers in entries with keyed hashes and drops
+// voters' names and email addresses. If the entries are already hashed, it
+// checks that they look like hashes instead.
+func hashRoll(secret []byte, entries []RollEntry, alreadyHashed bool) error {
+	for i, e := range entries {
+		if alreadyHashed {
+			if !hashedKeyRegexp.MatchString(e.StudentNumber) || !hashedKeyRegexp.MatchString(e.Username) {
+				return errors.Errorf("entry %d: identifiers aren't hex encoded HMAC-SHA256 hashes", i+1)
+			}
+		} else {
+			e.StudentNumber = hashVoterKey(secret, keyStudentNumber, e.StudentNumber)
+			e.Username = hashVoterKey(secret, keyUsername, e.Username)
+		}
+		e.Name = ""
+		e.Email = ""
+		entries[i] = e
+	}
+	return nil
+}
+
+// writeRollCSV writes entries in the CSV roll format.
+func writeRollCSV(w io.Writer, entries []RollEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(rollColumns); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		year := ""
+		if e.Year != 0 {
+			year = strconv.Itoa(e.Year)
+		}
+		if err := cw.Write([]string{e.StudentNumber, e.Username, e.Name, e.Program, year, e.Class, e.Email}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// rollColumns are the CSV columns of the voter roll. student_number and
+// username are required.
+var rollColumns = []string{"student_number", "username", "name", "program", "year", "class", "email"}
+
+// parseRoll reads a voter roll as JSON if the file name ends in .json, and as
+// CSV with a header row otherwise.
+func parseRoll(name string, r io.Reader) ([]RollEntry, error) {
+	var entries []RollEntry
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&entries); err != nil {
+			return nil, errors.Wrapf(err, "roll %q", name)
+		}
+	} else {
+		var err error
+		entries, err = parseRollCSV(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "roll %q", name)
+		}
+	}
+
+	students := map[string]bool{}
+	users := map[string]bool{}
+	for i, e := range entries {
+		e.StudentNumber = strings.TrimSpace(e.StudentNumber)
+		e.Username = strings.TrimSpace(e.Username)
+		if e.StudentNumber == "" || e.Username == "" {
+			return nil, errors.Errorf("roll %q: entry %d: student_number and username are required", name, i+1)
+		}
+		if students[e.StudentNumber] {
+			return nil, errors.Errorf("roll %q: duplicate student number %q", name, e.StudentNumber)
+		}
+		if users[e.Username] {
+			return nil, errors.Errorf("roll %q: duplicate username %q", name, e.Username)
+		}
+		students[e.StudentNumber] = true
+		users[e.Username] = true
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+func parseRollCSV(r io.Reader) ([]RollEntry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("missing header row")
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, column := range rollColumns {
+			known = known || column == name
+		}
+		if !known {
+			return nil, errors.Errorf("unknown column %q, expected some of %s", name, strings.Join(rollColumns, ", "))
+		}
+		columns[name] = i
+	}
+	for _, required := range rollColumns[:2] {
+		if _, ok := columns[required]; !ok {
+			return nil, errors.Errorf("missing column %q", required)
+		}
+	}
+
+	var entries []RollEntry
+	for i, record := range records[1:] {
+		get := func(column string) string {
+			if j, ok := columns[column]; ok {
+				return strings.TrimSpace(record[j])
+			}
+			return ""
+		}
+		e := RollEntry{
+			StudentNumber: get("student_number"),
+			Username:      get("username"),
+			Name:          get("name"),
+			Program:       get("program"),
+			Class:         get("class"),
+			Email:         get("email"),
+		}
+		if year := get("year"); year != "" {
+			if e.Year, err = strconv.Atoi(year); err != nil {
+				return nil, errors.Wrapf(err, "line %d: year", i+2)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// importRoll replaces the voter roll with entries. Unless the roll is hashed,
+// student numbers and usernames are stored normalized like voterKey, so they
+// can be looked up by the logged in user.
+func importRoll(db *gorm.DB, entries []RollEntry) error {
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	if err := tx.Delete(&RollEntry{}).Error; err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e := e
+		if !hashedRoll() {
+			e.StudentNumber = normalizeVoterKey(keyStudentNumber, e.StudentNumber)
+			e.Username = normalizeVoterKey(keyUsername, e.Username)
+		}
+		if err := tx.Create(&e).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// lookupRoll returns the voter roll entry for the student number, checking
+// that it belongs to the authenticated user. If no roll has been imported, the
+// student number is checked against the studentids list instead and the
+// returned entry is nil.
+func lookupRoll(db *gorm.DB, sid, user string) (*RollEntry, error) {
+	sidKey, err := voterKey(keyStudentNumber, sid)
+	if err != nil {
+		return nil, err
+	}
+	userKey, err := voterKey(keyUsername, user)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	if err := db.Model(&RollEntry{}).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, checkStudentIDs(sid, sidKey)
+	}
+
+	var entry RollEntry
+	if err := db.Where("student_number = ?", sidKey).First(&entry).Error; gorm.IsRecordNotFoundError(err) {
+		return nil, invalidStudentNumber(sid)
+	} else if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(entry.Username, userKey) {
+		if hashedRoll() {
+			return nil, errors.New("Student number doesn't belong to the CWL account you're logged in as. Make sure you typed it in correctly.")
+		}
+		return nil, errors.Errorf("Student number %q doesn't belong to the CWL account %q you're logged in as. Make sure you typed it in correctly.", sid, user)
+	}
+	return &entry, nil
+}
+
+// rollEntryForUser returns the voter roll entry for a username, or nil if they
+// aren't on the roll.
+func rollEntryForUser(db *gorm.DB, user string) (*RollEntry, error) {
+	userKey, err := voterKey(keyUsername, user)
+	if err != nil {
+		return nil, err
+	}
+	var entry RollEntry
+	if err := db.Where("username = ?", userKey).First(&entry).Error; gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// rollSize returns the number of voters on the voter roll, or in the
+// studentids list if no roll has been imported. It returns 0 if neither is
+// available.
+func rollSize(db *gorm.DB) (int, error) {
+	count := 0
+	if err := db.Model(&RollEntry{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return count, nil
+	}
+	sidsRaw, err := ioutil.ReadFile(c.StudentIDs)
+	if os.IsNotExist(err) || c.StudentIDs == "" {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, sid := range strings.Split(string(sidsRaw), "\n") {
+		if strings.TrimSpace(sid) != "" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// checkStudentIDs checks the student number against the studentids list,
+// which may list either student numbers or their hashes.
+func checkStudentIDs(sid, sidKey string) error {
+	sidsRaw, err := ioutil.ReadFile(c.StudentIDs)
+	if err != nil {
+		return err
+	}
+	sids := strings.Split(strings.TrimSpace(string(sidsRaw)), "\n")
+	for _, sid2 := range sids {
+		if sid2 = strings.TrimSpace(sid2); sid2 == sid || sid2 == sidKey {
+			return nil
+		}
+	}
+	return invalidStudentNumber(sid)
+}
+
+// invalidStudentNumber returns the error for a student number that isn't on
+// the roll. Errors are logged, so it leaves out the student number if the
+// roll is hashed.
+func invalidStudentNumber(sid string) error {
+	if hashedRoll() {
+		return errors.New("Invalid student number. Make sure you typed it in correctly and that you're a computer science student.")
+	}
+	return errors.Errorf("Invalid student number %q. Make sure you typed it in correctly and that you're a computer science student.", sid)
+}
+
+// runImportRoll implements the import-roll command.
+func runImportRoll(args []string) error {
+	fs := flag.NewFlagSet("import-roll", flag.ExitOnError)
+	hashed := fs.Bool("hashed", false, "the roll's student numbers and usernames are already hashed with hash-roll")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections import-roll [-hashed] <roll.csv|roll.json>\n\n"+
+			"Replaces the voter roll. CSV files need a header row naming the columns:\n  %s\n",
+			strings.Join(rollColumns, ","))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one roll file")
+	}
+
+	body, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	entries, err := parseRoll(fs.Arg(0), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	if hashedRoll() {
+		secret, err := loadRollSecret(c.RollSecret)
+		if err != nil {
+			return err
+		}
+		if err := hashRoll(secret, entries, *hashed); err != nil {
+			return err
+		}
+	} else if *hashed {
+		return errors.New("importing a hashed roll requires rollsecret in config.yml")
+	}
+	db, err := gorm.Open("sqlite3", c.DBPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to database")
+	}
+	defer db.Close()
+	if err := runMigrate(db); err != nil {
+		return err
+	}
+	if err := importRoll(db, entries); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(body)
+	audit(AuditRollChanged, map[string]string{
+		"entries": strconv.Itoa(len(entries)),
+		"sha256":  hex.EncodeToString(hash[:]),
+		"source":  "import",
+	})
+	fmt.Printf("Imported %d voters.\n", len(entries))
+	return nil
+}
+
+// runHashRoll implements the hash-roll command.
+func runHashRoll(args []string) error {
+	fs := flag.NewFlagSet("hash-roll", flag.ExitOnError)
+	secretFile := fs.String("secret", "", "the roll secret (defaults to rollsecret in config.yml)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections hash-roll [-secret roll.key] <roll.csv|roll.json> > hashed.csv\n\n"+
+			"Writes the roll with student numbers and usernames replaced by keyed hashes\n"+
+			"and names removed, ready for import-roll -hashed.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one roll file")
+	}
+
+	path := *secretFile
+	if path == "" {
+		if err := loadConfig(); err != nil {
+			return err
+		}
+		if !hashedRoll() {
+			return errors.New("no -secret given and rollsecret not set in config.yml")
+		}
+		path = c.RollSecret
+	}
+	secret, err := loadRollSecret(path)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	entries, err := parseRoll(fs.Arg(0), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := hashRoll(secret, entries, false); err != nil {
+		return err
+	}
+	return writeRollCSV(os.Stdout, entries)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRoll(t *testing.T) {
+	csvRoll := `Student_Number,Username,Name,Program,Year,Class,Email
+12345678,test,Voter,BSc CPSC,2,member,voter@example.com
+ 23456789 ,other,Other Voter,BCS,,member,
+`
+	entries, err := parseRoll("roll.csv", strings.NewReader(csvRoll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RollEntry{
+		{StudentNumber: "12345678", Username: "test", Name: "Voter", Program: "BSc CPSC", Year: 2, Class: "member", Email: "voter@example.com"},
+		{StudentNumber: "23456789", Username: "other", Name: "Other Voter", Program: "BCS", Class: "member"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v; wanted %+v", entries, want)
+	}
+
+	jsonRoll := `[
+		{"student_number": "12345678", "username": "test", "name": "Voter", "program": "BSc CPSC", "year": 2, "class": "member", "email": "voter@example.com"},
+		{"student_number": "23456789", "username": "other", "name": "Other Voter", "program": "BCS", "class": "member"}
+	]`
+	entries, err = parseRoll("roll.json", strings.NewReader(jsonRoll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v; wanted %+v", entries, want)
+	}
+
+	for _, bad := range []string{
+		"student_number,name\n1,A\n",
+		"student_number,username,phone\n1,a,555-0100\n",
+		"student_number,username\n1,a\n1,b\n",
+		"student_number,username\n1,a\n2,a\n",
+		"student_number,username,year\n1,a,first\n",
+		"student_number,username\n,a\n",
+	} {
+		if _, err := parseRoll("roll.csv", strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestVoteRoll(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := importRoll(s.db, []RollEntry{
+		{StudentNumber: "12345678", Username: "other"},
+		{StudentNumber: "34567890", Username: "test"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	vote := func(sid string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		req.Form.Set("student_number", sid)
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// In the student ID list but not on the imported roll.
+	if resp := vote("23456789"); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "Invalid student number") {
+		t.Fatalf("expected invalid student number; got %s", resp.Body.Bytes())
+	}
+	// Someone else's student number.
+	if resp := vote("12345678"); resp.Code != http.StatusInternalServerError || !strings.Contains(html.UnescapeString(resp.Body.String()), "doesn't belong to the CWL account") {
+		t.Fatalf("expected mismatch error; got %s", resp.Body.Bytes())
+	}
+	if resp := vote("34567890"); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+}
+
+func TestRollUsernameCase(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	c.Positions[5].Name = "First Year Rep"
+	c.Positions[5].Eligible = Eligibility{Years: []int{1}}
+	if err := importRoll(s.db, []RollEntry{
+		{StudentNumber: " 12345678 ", Username: "Test", Year: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// REMOTE_USER is "test".
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "First Year Rep") {
+		t.Fatalf("expected the roll entry to be found; got %s", resp.Body.Bytes())
+	}
+	req := httptest.NewRequest("POST", "/vote", nil)
+	req.Form = goodForm()
+	addCSRF(t, req)
+	resp = httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+}
+
+func TestHashedRoll(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	c.RollSecret = filepath.Join(filepath.Dir(c.PrivateKey), "roll.key")
+	if err := ioutil.WriteFile(c.RollSecret, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := loadRollSecret(c.RollSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hash the roll as hash-roll would, then import it as import-roll -hashed.
+	entries := []RollEntry{
+		{StudentNumber: "12345678", Username: "Test", Name: "Voter", Class: "member"},
+		{StudentNumber: "23456789", Username: "other", Name: "Other Voter", Class: "member"},
+	}
+	if err := hashRoll(secret, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeRollCSV(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "12345678") || strings.Contains(buf.String(), "Voter") {
+		t.Fatalf("hashed roll contains raw identifiers:\n%s", buf.String())
+	}
+	hashed, err := parseRoll("hashed.csv", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hashRoll(secret, hashed, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := hashRoll(secret, []RollEntry{{StudentNumber: "12345678", Username: "test"}}, true); err == nil {
+		t.Errorf("expected error importing unhashed roll as hashed")
+	}
+	if err := importRoll(s.db, hashed); err != nil {
+		t.Fatal(err)
+	}
+
+	vote := func(sid string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		req.Form.Set("student_number", sid)
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := vote("23456789"); resp.Code != http.StatusInternalServerError || strings.Contains(resp.Body.String(), "23456789") {
+		t.Fatalf("expected mismatch error without student number; got %s", resp.Body.Bytes())
+	}
+	if resp := vote("12345678"); resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if resp := vote("12345678"); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "already voted") {
+		t.Fatalf("expected double vote to be rejected; got %s", resp.Body.Bytes())
+	}
+
+	var voters []Voter
+	if err := s.db.Find(&voters).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := Voter{
+		StudentNumber: hashVoterKey(secret, keyStudentNumber, "12345678"),
+		Username:      hashVoterKey(secret, keyUsername, "test"),
+	}
+	if len(voters) != 1 || voters[0].StudentNumber != want.StudentNumber || voters[0].Username != want.Username || voters[0].Name != "" {
+		t.Fatalf("got voters %+v; wanted %+v", voters, want)
+	}
+
+	c.Admins = []string{"test"}
+	req := httptest.NewRequest("GET", "/admin", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if !strings.Contains(resp.Body.String(), "- "+want.StudentNumber+", "+want.Username+"\n") {
+		t.Errorf("admin page missing hashed voter:\n%s", resp.Body.String())
+	}
+
+	_, records := readAuditRecords(t)
+	for _, r := range records {
+		if (r.Event == AuditVoteAccepted || r.Event == AuditVoteRejected) && r.Details["user"] != want.Username {
+			t.Errorf("audit record has raw identifiers: %+v", r)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	// Embed the timezone database in case the server doesn't have one.
+	_ "time/tzdata"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Poll states.
+const (
+	PollPending = "pending"
+	PollOpen    = "open"
+	PollClosed  = "closed"
+)
+
+// scheduleLayouts are the accepted formats for opens_at and closes_at. Times
+// without an offset are in the configured timezone.
+var scheduleLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// scheduleDisplayLayout is how scheduled times are shown to voters.
+const scheduleDisplayLayout = "Monday, January 2 at 3:04 PM MST"
+
+// now returns the current time. Tests replace it to move the clock.
+var now = time.Now
+
+// Schedule is when voting opens and closes.
+type Schedule struct {
+	// OpensAt and ClosesAt are zero if not scheduled.
+	OpensAt  time.Time
+	ClosesAt time.Time
+}
+
+// location returns the configured timezone, defaulting to the server's.
+func (c Config) location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "timezone %q", c.Timezone)
+	}
+	return loc, nil
+}
+
+func parseScheduleTime(field, value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range scheduleLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.In(loc), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("%s: invalid time %q, expected e.g. \"2022-03-28 09:00\"", field, value)
+}
+
+// Schedule parses opens_at and closes_at.
+func (c Config) Schedule() (Schedule, error) {
+	loc, err := c.location()
+	if err != nil {
+		return Schedule{}, err
+	}
+	opens, err := parseScheduleTime("opens_at", c.OpensAt, loc)
+	if err != nil {
+		return Schedule{}, err
+	}
+	closes, err := parseScheduleTime("closes_at", c.ClosesAt, loc)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if !opens.IsZero() && !closes.IsZero() && !closes.After(opens) {
+		return Schedule{}, errors.Errorf("closes_at %q must be after opens_at %q", c.ClosesAt, c.OpensAt)
+	}
+	return Schedule{OpensAt: opens, ClosesAt: closes}, nil
+}
+
+// Scheduled reports whether opening or closing is scheduled.
+func (s Schedule) Scheduled() bool {
+	return !s.OpensAt.IsZero() || !s.ClosesAt.IsZero()
+}
+
+// PollState returns whether voting is pending, open or closed at t. Unless
+// voting is scheduled, the open flag in the config decides. Polls opened from
+// the admin console open early but still close as scheduled, and polls closed
+// from it stay closed.
+func (c Config) PollState(t time.Time) string {
+	s, err := c.Schedule()
+	if err != nil {
+		// setup rejects invalid schedules, so this shouldn't happen.
+		return PollClosed
+	}
+	if c.PollOverride == PollClosed {
+		return PollClosed
+	}
+	if !s.Scheduled() {
+		if c.Open || c.PollOverride == PollOpen {
+			return PollOpen
+		}
+		return PollClosed
+	}
+	if !s.ClosesAt.IsZero() && !t.Before(s.ClosesAt) {
+		return PollClosed
+	}
+	if !s.OpensAt.IsZero() && t.Before(s.OpensAt) && c.PollOverride != PollOpen {
+		return PollPending
+	}
+	return PollOpen
+}
+
+// pollsEnded reports whether voting has ended at t, because polls were
+// closed from the admin console or the scheduled closing time has passed,
+// rather than because they haven't been opened yet.
+func (c Config) pollsEnded(t time.Time) bool {
+	if c.PollOverride == PollClosed {
+		return true
+	}
+	s, err := c.Schedule()
+	return err == nil && !s.ClosesAt.IsZero() && !t.Before(s.ClosesAt)
+}
+
+// pollsOpen reports whether voting is open now.
+func pollsOpen() bool {
+	return c.PollState(now()) == PollOpen
+}
+
+// votingEnded reports whether voting has ended, so that the ballots can be
+// published and committed to. Polls that are closed because they haven't
+// opened yet, such as with open false and no schedule before the election,
+// haven't ended unless ballots have been cast.
+func votingEnded(db *gorm.DB) (bool, error) {
+	if c.pollsEnded(now()) {
+		return true, nil
+	}
+	if c.PollState(now()) != PollClosed {
+		return false, nil
+	}
+	return ballotsCast(db)
+}
+
+// formatScheduleTime formats t for display to voters.
+func formatScheduleTime(t time.Time) string {
+	return t.Format(scheduleDisplayLayout)
+}
+
+// checkPollOpen returns an error explaining why a ballot can't be accepted if
+// voting isn't open. loadedAt is when the ballot form was loaded, if known.
+func checkPollOpen(t time.Time, loadedAt string) error {
+	switch c.PollState(t) {
+	case PollOpen:
+		return nil
+	case PollPending:
+		s, _ := c.Schedule()
+		return errors.Errorf("Voting hasn't opened yet. Polls open %s.", formatScheduleTime(s.OpensAt))
+	}
+
+	s, _ := c.Schedule()
+	loaded, err := time.Parse(time.RFC3339, loadedAt)
+	if err != nil || s.ClosesAt.IsZero() || t.Before(s.ClosesAt) || !loaded.Before(s.ClosesAt) {
+		return errors.New("voting is closed")
+	}
+	loc, _ := c.location()
+	return errors.Errorf("Your ballot was not counted: it was submitted at %s, after polls closed at %s. The ballot form was loaded at %s, while voting was still open, but ballots must be submitted before polls close.",
+		t.In(loc).Format(scheduleDisplayLayout), formatScheduleTime(s.ClosesAt), loaded.In(loc).Format(scheduleDisplayLayout))
+}
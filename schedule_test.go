@@ -0,0 +1,136 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollState(t *testing.T) {
+	c = Config{
+		OpensAt:  "2022-03-28 09:00",
+		ClosesAt: "2022-03-30T17:00:00-07:00",
+		Timezone: "America/Vancouver",
+	}
+	s, err := c.Schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2022, 3, 28, 16, 0, 0, 0, time.UTC); !s.OpensAt.Equal(want) {
+		t.Errorf("opens at %s; wanted %s", s.OpensAt, want)
+	}
+	if got := formatScheduleTime(s.ClosesAt); got != "Wednesday, March 30 at 5:00 PM PDT" {
+		t.Errorf("got %q", got)
+	}
+
+	for _, tc := range []struct {
+		t    time.Time
+		want string
+	}{
+		{s.OpensAt.Add(-time.Second), PollPending},
+		{s.OpensAt, PollOpen},
+		{s.ClosesAt.Add(-time.Second), PollOpen},
+		{s.ClosesAt, PollClosed},
+	} {
+		if got := c.PollState(tc.t); got != tc.want {
+			t.Errorf("PollState(%s) = %q; wanted %q", tc.t, got, tc.want)
+		}
+	}
+
+	// Without a schedule the open flag decides.
+	c = Config{Open: true}
+	if got := c.PollState(time.Now()); got != PollOpen {
+		t.Errorf("got %q; wanted open", got)
+	}
+
+	// Closing polls from the console overrides both.
+	c.PollOverride = PollClosed
+	if got := c.PollState(time.Now()); got != PollClosed {
+		t.Errorf("got %q; wanted closed", got)
+	}
+
+	for _, bad := range []Config{
+		{OpensAt: "tomorrow"},
+		{OpensAt: "2022-03-28 09:00", Timezone: "Mars/Olympus_Mons"},
+		{OpensAt: "2022-03-28 09:00", ClosesAt: "2022-03-28 08:00"},
+	} {
+		if _, err := bad.Schedule(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestScheduledVoting(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+	defer func() { now = time.Now }()
+
+	c.Open = false
+	c.Timezone = "America/Vancouver"
+	c.OpensAt = "2022-03-28 09:00"
+	c.ClosesAt = "2022-03-30 17:00"
+	schedule, err := c.Schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+	vote := func(loadedAt time.Time) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = goodForm()
+		req.Form.Set("loaded_at", loadedAt.UTC().Format(time.RFC3339))
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Before polls open.
+	now = func() time.Time { return schedule.OpensAt.Add(-time.Hour) }
+	resp := get()
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Polls open Monday, March 28 at 9:00 AM PDT") ||
+		strings.Contains(resp.Body.String(), `action="vote"`) {
+		t.Fatalf("expected polls open message and no form; got %s", resp.Body.Bytes())
+	}
+	if resp := vote(now()); resp.Code != http.StatusInternalServerError || !strings.Contains(html.UnescapeString(resp.Body.String()), "hasn't opened yet") {
+		t.Fatalf("expected vote to be rejected; got %s", resp.Body.Bytes())
+	}
+
+	// While open.
+	now = func() time.Time { return schedule.ClosesAt.Add(-time.Hour) }
+	resp = get()
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Polls close Wednesday, March 30 at 5:00 PM PDT") ||
+		!strings.Contains(resp.Body.String(), `name="loaded_at"`) {
+		t.Fatalf("expected closing message and form; got %s", resp.Body.Bytes())
+	}
+	loadedAt := now()
+
+	// Submitted after close from a form loaded while open.
+	now = func() time.Time { return schedule.ClosesAt.Add(time.Minute) }
+	resp = vote(loadedAt)
+	if resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "after polls closed at Wednesday, March 30 at 5:00 PM PDT") {
+		t.Fatalf("expected late ballot to be rejected; got %s", resp.Body.Bytes())
+	}
+	if resp := get(); resp.Code != http.StatusInternalServerError {
+		t.Fatalf("expected voting to be closed; got %d", resp.Code)
+	}
+
+	_, records := readAuditRecords(t)
+	var late bool
+	for _, r := range records {
+		if r.Event == AuditVoteRejected && strings.Contains(r.Details["reason"], "after polls closed") {
+			late = true
+		}
+	}
+	if !late {
+		t.Errorf("late ballot not recorded in audit log: %+v", records)
+	}
+}
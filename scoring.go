@@ -0,0 +1,76 @@
+package main
+
+import "github.com/pkg/errors"
+
+// scorePoll elects the candidates with the highest scores, where each ballot
+// adds to the score of the candidates it ranks.
+type scorePoll struct {
+	ballotBox
+	method string
+	seats  int
+	score  func(ranking []string, numCandidates int, tallies map[string]float64)
+}
+
+func newScorePoll(method string, candidates []string, seats int, score func([]string, int, map[string]float64)) (*scorePoll, error) {
+	if seats < 1 {
+		return nil, errors.Errorf("%s: invalid number of seats %d", method, seats)
+	}
+	box, err := newBallotBox(candidates)
+	if err != nil {
+		return nil, errors.Wrap(err, method)
+	}
+	return &scorePoll{
+		ballotBox: box,
+		method:    method,
+		seats:     seats,
+		score:     score,
+	}, nil
+}
+
+// pluralityScore gives one point to the first choice.
+func pluralityScore(ranking []string, numCandidates int, tallies map[string]float64) {
+	tallies[ranking[0]]++
+}
+
+// approvalScore gives one point to every ranked candidate.
+func approvalScore(ranking []string, numCandidates int, tallies map[string]float64) {
+	for _, c := range ranking {
+		tallies[c]++
+	}
+}
+
+// bordaScore gives n-1 points to the first choice, n-2 to the second and so
+// on, where n is the number of candidates. Unranked candidates get nothing.
+func bordaScore(ranking []string, numCandidates int, tallies map[string]float64) {
+	for i, c := range ranking {
+		tallies[c] += float64(numCandidates - 1 - i)
+	}
+}
+
+func (p *scorePoll) Evaluate() (*Result, error) {
+	if len(p.ballots) == 0 {
+		return nil, errors.Errorf("%s: no ballots", p.method)
+	}
+	round := Round{Tallies: map[string]float64{}}
+	for _, c := range p.candidates {
+		round.Tallies[c] = 0
+	}
+	for _, ballot := range p.ballots {
+		p.score(ballot, len(p.candidates), round.Tallies)
+	}
+	tb := p.newTieBreaker()
+	var err error
+	round.Elected, round.Tied, round.TieBreak, err = tb.topN(p.candidates, round.Tallies, p.seats, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Method:     p.method,
+		Candidates: p.candidates,
+		Seats:      p.seats,
+		Winners:    round.Elected,
+		Rounds:     []Round{round},
+	}
+	tb.describe(res)
+	return res, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	listen         = flag.String("listen", "", "serve HTTP on this address, e.g. localhost:8080, instead of running as a CGI script")
+	authHeader     = flag.String("authheader", "", "with -listen, the header a reverse proxy sets to the logged in user, instead of the auth method in config.yml")
+	trustedProxies = flag.String("trustedproxies", "", "with -listen, comma separated addresses or CIDR ranges of the reverse proxies allowed to set the auth header, instead of trusted_proxies in config.yml; by default only loopback addresses")
+)
+
+// shutdownTimeout is how long the server waits for requests in progress to
+// finish when it's stopped.
+const shutdownTimeout = 10 * time.Second
+
+// mailInterval is how often the standalone server sends queued mail.
+const mailInterval = time.Minute
+
+// ServeHTTP implements http.Handler. Paths are relative to the script, so
+// anything up to and including elections.cgi is stripped.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bits := strings.Split(r.URL.Path, "elections.cgi")
+	if len(bits) == 2 {
+		r.URL.Path = bits[1]
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+	}
+	log.Printf("%s %s", r.Method, r.URL.Path)
+	s.mux.ServeHTTP(w, r)
+}
+
+// readConfig wraps a handler that reads the parts of the config the admin
+// console changes, so that it doesn't see a change half made.
+func (s *server) readConfig(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		h(w, r)
+	}
+}
+
+// changeConfig wraps a handler that changes the config, such as the admin
+// console, so that no other request reads it at the same time.
+func (s *server) changeConfig(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		h(w, r)
+	}
+}
+
+// sendMailEvery sends queued mail every interval until ctx is done, so that
+// mail is sent without running send-mail from cron. The admin console
+// doesn't change the SMTP config, so no lock is needed.
+func (s *server) sendMailEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := flushOutbox(s.db); err != nil {
+			log.Printf("sending mail: %s", err)
+		}
+	}
+}
+
+// serve handles requests on l until ctx is done, then waits up to
+// shutdownTimeout for requests in progress to finish.
+func (s *server) serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	if mailEnabled() {
+		go s.sendMailEvery(ctx, mailInterval)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// listenAndServe runs the standalone server on addr until it's interrupted
+// or terminated. REMOTE_USER isn't set per request outside of CGI, so another
+// authentication method is required. With header auth, the server must only
+// be reachable from loopback addresses unless the trusted proxies are set.
+func (s *server) listenAndServe(addr string) error {
+	if _, ok := s.auth.(cgiAuth); ok {
+		return errors.New("-listen requires -authheader or another auth method in config.yml")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.auth.(headerAuth); ok && len(trustedProxyList()) == 0 {
+		if tcp, ok := l.Addr().(*net.TCPAddr); !ok || !tcp.IP.IsLoopback() {
+			l.Close()
+			return errors.Errorf("listening on %s, which isn't a loopback address, requires -trustedproxies or trusted_proxies in config.yml with header auth", l.Addr())
+		}
+	}
+	log.Printf("listening on %s", l.Addr())
+	return s.serve(ctx, l)
+}
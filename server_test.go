@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+	c.Admins = []string{"test"}
+	*listen = "127.0.0.1:0"
+	defer func() { *listen = "" }()
+	auth, err := newHeaderAuth("X-Remote-User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = auth
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(ctx, l)
+	}()
+	base := "http://" + l.Addr().String() + "/elections.cgi"
+
+	get := func(path, user string) string {
+		req, err := http.NewRequest("GET", base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.Header.Set("X-Remote-User", user)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	// REMOTE_USER is ignored; the user comes from the header.
+	if body := get("/admin", ""); !strings.Contains(body, "missing X-Remote-User header") {
+		t.Errorf("expected request without header to be rejected:\n%s", body)
+	}
+	if body := get("/admin", "other"); !strings.Contains(body, "must be an admin") {
+		t.Errorf("expected non-admin to be rejected:\n%s", body)
+	}
+	if body := get("/admin", "test"); !strings.Contains(body, "Voter count: 0") {
+		t.Errorf("expected admin page:\n%s", body)
+	}
+
+	form := goodForm()
+	token, err := csrfToken(testCSRFSession, "user:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set(csrfField, token)
+	req, err := http.NewRequest("POST", base+"/vote", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Remote-User", "test")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFSession})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("vote got status %d", resp.StatusCode)
+	}
+	if body := get("/admin", "test"); !strings.Contains(body, "Voter count: 1") {
+		t.Errorf("expected vote to be recorded:\n%s", body)
+	}
+
+	// Only requests that read what the admin console changes wait for it.
+	s.mu.Lock()
+	client := &http.Client{Timeout: 5 * time.Second}
+	pubkey, err := client.Get(base + "/pubkey")
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("expected public key to be served while the config is locked: %v", err)
+	}
+	pubkey.Body.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("shutdown: %+v", err)
+	}
+	if _, err := http.Get(base + "/"); err == nil {
+		t.Errorf("expected server to be stopped")
+	}
+}
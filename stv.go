@@ -0,0 +1,337 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Surplus transfer methods supported by the STV count.
+const (
+	// TransferGregory transfers every ballot held by an elected candidate at a
+	// reduced transfer value (weighted inclusive Gregory method).
+	TransferGregory = "gregory"
+	// TransferMeek iteratively computes keep factors for elected candidates so
+	// every ballot is redistributed as if the count started over.
+	TransferMeek = "meek"
+)
+
+// meekMaxIterations bounds the keep factor convergence loop.
+const meekMaxIterations = 1000
+
+type stvState int
+
+const (
+	stvHopeful stvState = iota
+	stvElected
+	stvExcluded
+)
+
+// STVPoll counts ranked ballots for a position with one or more seats using
+// the single transferable vote and the Droop quota.
+type STVPoll struct {
+	ballotBox
+	seats    int
+	transfer string
+}
+
+// NewSTVPoll creates a poll filling seats from candidates. An empty transfer
+// method defaults to TransferGregory.
+func NewSTVPoll(candidates []string, seats int, transfer string) (*STVPoll, error) {
+	if seats < 1 {
+		return nil, errors.Errorf("stv: invalid number of seats %d", seats)
+	}
+	box, err := newBallotBox(candidates)
+	if err != nil {
+		return nil, errors.Wrap(err, "stv")
+	}
+	if transfer == "" {
+		transfer = TransferGregory
+	}
+	if transfer != TransferGregory && transfer != TransferMeek {
+		return nil, errors.Errorf("stv: unknown transfer method %q", transfer)
+	}
+	return &STVPoll{
+		ballotBox: box,
+		seats:     seats,
+		transfer:  transfer,
+	}, nil
+}
+
+// Evaluate runs the count and returns every round of it.
+func (p *STVPoll) Evaluate() (*Result, error) {
+	if len(p.ballots) == 0 {
+		return nil, errors.New("stv: no ballots")
+	}
+	res := &Result{
+		Method:     MethodSTV,
+		Candidates: p.candidates,
+		Seats:      p.seats,
+		Transfer:   p.transfer,
+	}
+	tb := p.newTieBreaker()
+	tb.describe(res)
+	var err error
+	if p.transfer == TransferMeek {
+		err = p.meek(res, tb)
+	} else {
+		err = p.gregory(res, tb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// droopQuota returns the smallest whole number of votes that only seats
+// candidates can reach.
+func droopQuota(votes float64, seats int) float64 {
+	return math.Floor(votes/float64(seats+1)) + 1
+}
+
+type stvBallot struct {
+	ranking []string
+	weight  float64
+	pos     int
+}
+
+func (p *STVPoll) gregory(res *Result, tb *tieBreaker) error {
+	state := map[string]stvState{}
+	held := map[string][]*stvBallot{}
+	// settled holds the value of elected candidates whose surplus has already
+	// been transferred.
+	settled := map[string]float64{}
+	exhausted := 0.0
+
+	give := func(b *stvBallot) {
+		for ; b.pos < len(b.ranking); b.pos++ {
+			c := b.ranking[b.pos]
+			if state[c] == stvHopeful {
+				held[c] = append(held[c], b)
+				return
+			}
+		}
+		exhausted += b.weight
+	}
+	for _, ranking := range p.ballots {
+		give(&stvBallot{ranking: ranking, weight: 1})
+	}
+
+	res.Quota = droopQuota(float64(len(p.ballots)), p.seats)
+	var pending []string
+
+	for {
+		round := Round{
+			Tallies: map[string]float64{},
+			Quota:   res.Quota,
+		}
+		for _, c := range p.candidates {
+			if state[c] == stvExcluded {
+				continue
+			}
+			if v, ok := settled[c]; ok {
+				round.Tallies[c] = v
+				continue
+			}
+			total := 0.0
+			for _, b := range held[c] {
+				total += b.weight
+			}
+			round.Tallies[c] = total
+		}
+		round.Exhausted = exhausted
+
+		var reached []string
+		for _, c := range p.hopefuls(state) {
+			if round.Tallies[c] >= res.Quota-tallyEpsilon {
+				reached = append(reached, c)
+			}
+		}
+		p.elect(res, &round, state, reached)
+		pending = append(pending, reached...)
+
+		if p.finish(res, &round, state) {
+			res.Rounds = append(res.Rounds, round)
+			return nil
+		}
+
+		// Transfer the largest outstanding surplus, if any.
+		from := ""
+		for _, c := range pending {
+			if round.Tallies[c]-res.Quota > tallyEpsilon && (from == "" || round.Tallies[c] > round.Tallies[from]) {
+				from = c
+			}
+		}
+		if from != "" {
+			surplus := round.Tallies[from] - res.Quota
+			value := surplus / round.Tallies[from]
+			round.Transfer = &Transfer{From: from, Surplus: surplus, Value: value}
+			ballots := held[from]
+			held[from] = nil
+			settled[from] = res.Quota
+			for _, b := range ballots {
+				b.weight *= value
+				give(b)
+			}
+			pending = remove(pending, from)
+			res.Rounds = append(res.Rounds, round)
+			continue
+		}
+		for _, c := range pending {
+			settled[c] = round.Tallies[c]
+			held[c] = nil
+		}
+		pending = nil
+
+		excluded, tied, rule, err := tb.lowest(p.hopefuls(state), round, res.Rounds)
+		if err != nil {
+			return err
+		}
+		round.Excluded = excluded
+		round.Tied = tied
+		round.TieBreak = rule
+		state[excluded] = stvExcluded
+		ballots := held[excluded]
+		held[excluded] = nil
+		for _, b := range ballots {
+			give(b)
+		}
+		res.Rounds = append(res.Rounds, round)
+	}
+}
+
+func (p *STVPoll) meek(res *Result, tb *tieBreaker) error {
+	state := map[string]stvState{}
+	keep := map[string]float64{}
+	for _, c := range p.candidates {
+		keep[c] = 1
+	}
+
+	for {
+		var tallies map[string]float64
+		var exhausted, quota float64
+		for i := 0; i < meekMaxIterations; i++ {
+			tallies, exhausted = p.meekDistribute(keep)
+			quota = (float64(len(p.ballots)) - exhausted) / float64(p.seats+1)
+			converged := true
+			for _, c := range p.candidates {
+				if state[c] != stvElected || tallies[c] <= 0 {
+					continue
+				}
+				if math.Abs(tallies[c]-quota) > tallyEpsilon*float64(len(p.ballots)) {
+					converged = false
+				}
+				keep[c] = math.Min(1, keep[c]*quota/tallies[c])
+			}
+			if converged {
+				break
+			}
+		}
+
+		round := Round{
+			Tallies:   map[string]float64{},
+			Exhausted: exhausted,
+			Quota:     quota,
+			Keep:      map[string]float64{},
+		}
+		for _, c := range p.candidates {
+			if state[c] == stvExcluded {
+				continue
+			}
+			round.Tallies[c] = tallies[c]
+			if state[c] == stvElected {
+				round.Keep[c] = keep[c]
+			}
+		}
+		res.Quota = quota
+
+		var reached []string
+		for _, c := range p.hopefuls(state) {
+			if tallies[c]-quota > tallyEpsilon {
+				reached = append(reached, c)
+			}
+		}
+		p.elect(res, &round, state, reached)
+
+		if p.finish(res, &round, state) {
+			res.Rounds = append(res.Rounds, round)
+			return nil
+		}
+		if len(reached) > 0 {
+			res.Rounds = append(res.Rounds, round)
+			continue
+		}
+
+		excluded, tied, rule, err := tb.lowest(p.hopefuls(state), round, res.Rounds)
+		if err != nil {
+			return err
+		}
+		round.Excluded = excluded
+		round.Tied = tied
+		round.TieBreak = rule
+		state[excluded] = stvExcluded
+		keep[excluded] = 0
+		res.Rounds = append(res.Rounds, round)
+	}
+}
+
+// meekDistribute passes each ballot down its ranking, leaving the keep factor
+// share of its remaining weight with each candidate.
+func (p *STVPoll) meekDistribute(keep map[string]float64) (map[string]float64, float64) {
+	tallies := map[string]float64{}
+	exhausted := 0.0
+	for _, ranking := range p.ballots {
+		weight := 1.0
+		for _, c := range ranking {
+			k := keep[c]
+			tallies[c] += weight * k
+			weight *= 1 - k
+			if weight < tallyEpsilon {
+				weight = 0
+				break
+			}
+		}
+		exhausted += weight
+	}
+	return tallies, exhausted
+}
+
+func (p *STVPoll) hopefuls(state map[string]stvState) []string {
+	var hopefuls []string
+	for _, c := range p.candidates {
+		if state[c] == stvHopeful {
+			hopefuls = append(hopefuls, c)
+		}
+	}
+	return hopefuls
+}
+
+// elect marks candidates as elected in order of their tally.
+func (p *STVPoll) elect(res *Result, round *Round, state map[string]stvState, candidates []string) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return round.Tallies[candidates[i]] > round.Tallies[candidates[j]]
+	})
+	for _, c := range candidates {
+		if len(res.Winners) >= p.seats {
+			return
+		}
+		state[c] = stvElected
+		res.Winners = append(res.Winners, c)
+		round.Elected = append(round.Elected, c)
+	}
+}
+
+// finish reports whether the count is over, electing the remaining hopeful
+// candidates if there are no more of them than there are vacant seats.
+func (p *STVPoll) finish(res *Result, round *Round, state map[string]stvState) bool {
+	if len(res.Winners) >= p.seats {
+		return true
+	}
+	hopefuls := p.hopefuls(state)
+	if len(hopefuls) > p.seats-len(res.Winners) {
+		return false
+	}
+	p.elect(res, round, state, hopefuls)
+	return true
+}
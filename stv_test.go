@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func stvBallots(t *testing.T, poll *STVPoll, n int, ranking ...string) {
+	for i := 0; i < n; i++ {
+		if err := poll.AddBallot(ranking); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSTVGregory(t *testing.T) {
+	poll, err := NewSTVPoll([]string{"A", "B", "C"}, 2, TransferGregory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stvBallots(t, poll, 6, "A", "B")
+	stvBallots(t, poll, 2, "A", "C")
+	stvBallots(t, poll, 3, "C")
+	stvBallots(t, poll, 2, "B")
+
+	res, err := poll.Evaluate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Quota != 5 {
+		t.Errorf("quota = %f; wanted 5", res.Quota)
+	}
+	if want := []string{"A", "B"}; !reflect.DeepEqual(res.Winners, want) {
+		t.Fatalf("got winners = %+v; wanted %+v", res.Winners, want)
+	}
+	if len(res.Rounds) != 3 {
+		t.Fatalf("got %d rounds; wanted 3", len(res.Rounds))
+	}
+
+	transfer := res.Rounds[0].Transfer
+	if transfer == nil || transfer.From != "A" || transfer.Surplus != 3 || transfer.Value != 0.375 {
+		t.Errorf("round 1 transfer = %+v", transfer)
+	}
+	if got := res.Rounds[1].Tallies["B"]; got != 4.25 {
+		t.Errorf("round 2 B = %f; wanted 4.25", got)
+	}
+	if got := res.Rounds[1].Excluded; got != "C" {
+		t.Errorf("round 2 excluded = %q; wanted C", got)
+	}
+	if got := res.Rounds[2].Exhausted; got != 3.75 {
+		t.Errorf("round 3 exhausted = %f; wanted 3.75", got)
+	}
+}
+
+func TestSTVMeek(t *testing.T) {
+	poll, err := NewSTVPoll([]string{"A", "B", "C", "D"}, 2, TransferMeek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stvBallots(t, poll, 10, "A", "B")
+	stvBallots(t, poll, 4, "C", "B")
+	stvBallots(t, poll, 5, "D")
+	stvBallots(t, poll, 1, "B")
+
+	res, err := poll.Evaluate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A", "B"}; !reflect.DeepEqual(res.Winners, want) {
+		t.Fatalf("got winners = %+v; wanted %+v", res.Winners, want)
+	}
+	last := res.Rounds[len(res.Rounds)-1]
+	total := last.Exhausted
+	for _, v := range last.Tallies {
+		total += v
+	}
+	if math.Abs(total-20) > 1e-6 {
+		t.Errorf("votes not conserved: %f", total)
+	}
+}
+
+func TestSTVExcludeTie(t *testing.T) {
+	poll, err := NewSTVPoll([]string{"A", "B", "C", "D"}, 2, TransferGregory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll.SetTieBreak(TieBreak{Rules: []string{TieBreakBackwards}})
+	stvBallots(t, poll, 4, "A")
+	stvBallots(t, poll, 3, "B")
+	stvBallots(t, poll, 2, "C")
+	stvBallots(t, poll, 2, "D")
+
+	res, err := poll.Evaluate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	round := res.Rounds[0]
+	if round.Excluded != "D" || !reflect.DeepEqual(round.Tied, []string{"C", "D"}) || round.TieBreak != "order listed" {
+		t.Fatalf("got excluded %q tied %+v by %q", round.Excluded, round.Tied, round.TieBreak)
+	}
+}
+
+func TestSTVInvalidBallot(t *testing.T) {
+	poll, err := NewSTVPoll([]string{"A", "B"}, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := poll.AddBallot([]string{"A", "A"}); err == nil {
+		t.Error("expected error for duplicate ranking")
+	}
+	if err := poll.AddBallot([]string{"Z"}); err == nil {
+		t.Error("expected error for unknown candidate")
+	}
+	if _, err := NewSTVPoll([]string{"A"}, 1, "hare"); err == nil {
+		t.Error("expected error for unknown transfer method")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Tallier counts ranked ballots for a single position.
+type Tallier interface {
+	// AddBallot adds a ballot ranking candidates from most to least preferred.
+	AddBallot(ranking []string) error
+	// SetTieBreak configures how ties are resolved.
+	SetTieBreak(tb TieBreak)
+	// Evaluate runs the count.
+	Evaluate() (*Result, error)
+}
+
+// TallyOptions configures how a Tallier counts ballots.
+type TallyOptions struct {
+	Seats    int
+	Transfer string
+}
+
+// Method is a voting method that positions can be counted with.
+type Method struct {
+	Name string
+	URL  string
+	// Note explains to voters how their ranking is used.
+	Note string
+	// MultiSeat is true if the method can fill more than one seat.
+	MultiSeat bool
+	New       func(candidates []string, opts TallyOptions) (Tallier, error)
+}
+
+// Voting methods selectable with the method key of a position.
+const (
+	MethodIRV         = "irv"
+	MethodSTV         = "stv"
+	MethodPlurality   = "plurality"
+	MethodApproval    = "approval"
+	MethodBorda       = "borda"
+	MethodSchulze     = "schulze"
+	MethodRankedPairs = "rankedpairs"
+)
+
+var methods = map[string]Method{
+	MethodIRV: {
+		Name: "instant-runoff voting",
+		URL:  "https://en.wikipedia.org/wiki/Instant-runoff_voting",
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return NewIRVPoll(candidates)
+		},
+	},
+	MethodSTV: {
+		Name:      "the single transferable vote",
+		URL:       "https://en.wikipedia.org/wiki/Single_transferable_vote",
+		MultiSeat: true,
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return NewSTVPoll(candidates, opts.Seats, opts.Transfer)
+		},
+	},
+	MethodPlurality: {
+		Name:      "plurality voting",
+		URL:       "https://en.wikipedia.org/wiki/Plurality_voting",
+		Note:      "Only your first choice is counted.",
+		MultiSeat: true,
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return newScorePoll(MethodPlurality, candidates, opts.Seats, pluralityScore)
+		},
+	},
+	MethodApproval: {
+		Name:      "approval voting",
+		URL:       "https://en.wikipedia.org/wiki/Approval_voting",
+		Note:      "Every candidate you rank counts as approved; the order does not matter.",
+		MultiSeat: true,
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return newScorePoll(MethodApproval, candidates, opts.Seats, approvalScore)
+		},
+	},
+	MethodBorda: {
+		Name:      "the Borda count",
+		URL:       "https://en.wikipedia.org/wiki/Borda_count",
+		MultiSeat: true,
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return newScorePoll(MethodBorda, candidates, opts.Seats, bordaScore)
+		},
+	},
+	MethodSchulze: {
+		Name:      "the Schulze method",
+		URL:       "https://en.wikipedia.org/wiki/Schulze_method",
+		MultiSeat: true,
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return NewSchulzePoll(candidates, opts.Seats)
+		},
+	},
+	MethodRankedPairs: {
+		Name:      "the ranked pairs method",
+		URL:       "https://en.wikipedia.org/wiki/Ranked_pairs",
+		MultiSeat: true,
+		New: func(candidates []string, opts TallyOptions) (Tallier, error) {
+			return NewRankedPairsPoll(candidates, opts.Seats)
+		},
+	},
+}
+
+// tallyEpsilon is the tolerance used when comparing fractional vote values.
+const tallyEpsilon = 1e-9
+
+// Transfer describes the distribution of an elected candidate's surplus.
+type Transfer struct {
+	From    string  `json:"from"`
+	Surplus float64 `json:"surplus"`
+	Value   float64 `json:"value"`
+}
+
+// Round is the state of a count at the start of a round and the action that
+// was taken during it. Methods that count in a single step have one round.
+type Round struct {
+	Tallies   map[string]float64 `json:"tallies"`
+	Exhausted float64            `json:"exhausted"`
+	Quota     float64            `json:"quota,omitempty"`
+
+	Elected  []string           `json:"elected,omitempty"`
+	Excluded string             `json:"excluded,omitempty"`
+	Transfer *Transfer          `json:"transfer,omitempty"`
+	Keep     map[string]float64 `json:"keep,omitempty"`
+	Tied     []string           `json:"tied,omitempty"`
+	// TieBreak is the rule that resolved the tie, if any.
+	TieBreak string   `json:"tie_break,omitempty"`
+	Notes    []string `json:"notes,omitempty"`
+}
+
+// Result is the outcome of counting a position.
+type Result struct {
+	Method     string   `json:"method"`
+	Candidates []string `json:"candidates"`
+	Seats      int      `json:"seats"`
+	Transfer   string   `json:"transfer,omitempty"`
+	Quota      float64  `json:"quota,omitempty"`
+	Winners    []string `json:"winners"`
+	Rounds     []Round  `json:"rounds"`
+	// Pairwise holds, for Condorcet methods, the number of ballots preferring
+	// each candidate over each other candidate.
+	Pairwise map[string]map[string]int `json:"pairwise,omitempty"`
+	// TieBreak lists the tie-break rules in effect and Seed is the seed for
+	// random draws, if any.
+	TieBreak []string `json:"tie_break,omitempty"`
+	Seed     *int64   `json:"seed,omitempty"`
+}
+
+// ballotBox validates and stores ranked ballots.
+type ballotBox struct {
+	candidates []string
+	ballots    [][]string
+	tieBreak   TieBreak
+}
+
+func newBallotBox(candidates []string) (ballotBox, error) {
+	if len(candidates) == 0 {
+		return ballotBox{}, errors.New("no candidates")
+	}
+	seen := map[string]struct{}{}
+	for _, c := range candidates {
+		if _, ok := seen[c]; ok {
+			return ballotBox{}, errors.Errorf("duplicate candidate %q", c)
+		}
+		seen[c] = struct{}{}
+	}
+	return ballotBox{candidates: candidates}, nil
+}
+
+func (b *ballotBox) AddBallot(ranking []string) error {
+	if len(ranking) == 0 {
+		return errors.New("empty ballot")
+	}
+	seen := map[string]struct{}{}
+	for _, c := range ranking {
+		if !b.isCandidate(c) {
+			return errors.Errorf("unknown candidate %q", c)
+		}
+		if _, ok := seen[c]; ok {
+			return errors.Errorf("candidate %q ranked twice", c)
+		}
+		seen[c] = struct{}{}
+	}
+	b.ballots = append(b.ballots, ranking)
+	return nil
+}
+
+func (b *ballotBox) SetTieBreak(tb TieBreak) {
+	b.tieBreak = tb
+}
+
+func (b *ballotBox) newTieBreaker() *tieBreaker {
+	return newTieBreaker(b.tieBreak, b.ballots)
+}
+
+func (b *ballotBox) isCandidate(c string) bool {
+	for _, c2 := range b.candidates {
+		if c == c2 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeResult writes a human readable report of every round of a count.
+func writeResult(w io.Writer, res *Result) {
+	fmt.Fprintf(w, "  Method: %s\n", res.Method)
+	if res.Seats > 1 {
+		fmt.Fprintf(w, "  Seats: %d\n", res.Seats)
+	}
+	if res.Transfer != "" {
+		fmt.Fprintf(w, "  Transfer: %s\n", res.Transfer)
+	}
+	if res.Quota > 0 && res.Transfer != TransferMeek {
+		fmt.Fprintf(w, "  Quota: %.4f (Droop)\n", res.Quota)
+	}
+	if res.Seats > 1 {
+		fmt.Fprintf(w, "  Winners: %s\n", strings.Join(res.Winners, ","))
+	} else {
+		fmt.Fprintf(w, "  Winner: %s\n", strings.Join(res.Winners, ","))
+	}
+	if len(res.TieBreak) > 0 {
+		fmt.Fprintf(w, "  Tie-break: %s", strings.Join(res.TieBreak, ", "))
+		if res.Seed != nil {
+			fmt.Fprintf(w, " (seed %d)", *res.Seed)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if res.Pairwise != nil {
+		fmt.Fprintf(w, "  Pairwise:\n")
+		for i, a := range res.Candidates {
+			for _, b := range res.Candidates[i+1:] {
+				fmt.Fprintf(w, "    - %s vs %s: %d to %d\n", a, b, res.Pairwise[a][b], res.Pairwise[b][a])
+			}
+		}
+	}
+	for i, round := range res.Rounds {
+		fmt.Fprintf(w, "  - Round %d:\n", i+1)
+		if res.Transfer == TransferMeek {
+			fmt.Fprintf(w, "    Quota: %.4f\n", round.Quota)
+		}
+		for _, c := range res.Candidates {
+			v, ok := round.Tallies[c]
+			if !ok {
+				continue
+			}
+			if k, ok := round.Keep[c]; ok {
+				fmt.Fprintf(w, "    - %s: %.4f (keep %.6f)\n", c, v, k)
+			} else {
+				fmt.Fprintf(w, "    - %s: %.4f\n", c, v)
+			}
+		}
+		if round.Exhausted > 0 {
+			fmt.Fprintf(w, "    - Exhausted: %.4f\n", round.Exhausted)
+		}
+		for _, note := range round.Notes {
+			fmt.Fprintf(w, "    %s\n", note)
+		}
+		if len(round.Elected) > 0 {
+			fmt.Fprintf(w, "    Elected: %s\n", strings.Join(round.Elected, ","))
+		}
+		if t := round.Transfer; t != nil {
+			fmt.Fprintf(w, "    Transferred surplus of %s: %.4f at value %.6f\n", t.From, t.Surplus, t.Value)
+		}
+		switch {
+		case round.Excluded != "" && len(round.Tied) > 0:
+			fmt.Fprintf(w, "    Excluded: %s (tied with %s; broken by %s)\n", round.Excluded, strings.Join(remove(round.Tied, round.Excluded), ","), round.TieBreak)
+		case round.Excluded != "":
+			fmt.Fprintf(w, "    Excluded: %s\n", round.Excluded)
+		case len(round.Tied) > 0:
+			fmt.Fprintf(w, "    Tied: %s (broken by %s)\n", strings.Join(round.Tied, ","), round.TieBreak)
+		}
+	}
+}
+
+func remove(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
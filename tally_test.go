@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tennessee is the ballot profile from the Wikipedia voting method articles
+// where each method elects a different city.
+func tennessee(t *testing.T, tallier Tallier) {
+	add := func(n int, ranking ...string) {
+		for i := 0; i < n; i++ {
+			if err := tallier.AddBallot(ranking); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(42, "Memphis", "Nashville", "Chattanooga", "Knoxville")
+	add(26, "Nashville", "Chattanooga", "Knoxville", "Memphis")
+	add(15, "Chattanooga", "Knoxville", "Nashville", "Memphis")
+	add(17, "Knoxville", "Chattanooga", "Nashville", "Memphis")
+}
+
+func TestMethods(t *testing.T) {
+	cities := []string{"Memphis", "Nashville", "Chattanooga", "Knoxville"}
+	cases := []struct {
+		method string
+		want   []string
+	}{
+		{MethodIRV, []string{"Knoxville"}},
+		{MethodSTV, []string{"Knoxville"}},
+		{MethodPlurality, []string{"Memphis"}},
+		{MethodBorda, []string{"Nashville"}},
+		{MethodSchulze, []string{"Nashville"}},
+		{MethodRankedPairs, []string{"Nashville"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.method, func(t *testing.T) {
+			tallier, err := methods[tc.method].New(cities, TallyOptions{Seats: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tennessee(t, tallier)
+			res, err := tallier.Evaluate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res.Winners, tc.want) {
+				t.Fatalf("got winners = %+v; wanted %+v", res.Winners, tc.want)
+			}
+			var buf bytes.Buffer
+			writeResult(&buf, res)
+			if !strings.Contains(buf.String(), "Winner: "+tc.want[0]) {
+				t.Errorf("report missing winner:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestApprovalMultiSeat(t *testing.T) {
+	tallier, err := methods[MethodApproval].New([]string{"A", "B", "C"}, TallyOptions{Seats: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ballot := range [][]string{{"A", "B"}, {"B"}, {"C", "B"}, {"A"}} {
+		if err := tallier.AddBallot(ballot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := tallier.Evaluate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"B", "A"}; !reflect.DeepEqual(res.Winners, want) {
+		t.Fatalf("got winners = %+v; wanted %+v", res.Winners, want)
+	}
+}
+
+func TestPositionTallier(t *testing.T) {
+	if _, err := (Position{Name: "P", Method: "dictator"}).Tallier(); err == nil {
+		t.Error("expected error for unknown method")
+	}
+	if _, err := (Position{Name: "P", Method: MethodIRV, Seats: 2}).Tallier(); err == nil {
+		t.Error("expected error for multi-seat irv")
+	}
+	p := Position{Name: "P", Seats: 3, Candidates: []string{"A", "B"}}
+	if got := p.MethodName(); got != MethodSTV {
+		t.Errorf("got method %q; wanted stv", got)
+	}
+	if _, err := p.Tallier(); err != nil {
+		t.Fatal(err)
+	}
+}
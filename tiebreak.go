@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Tie-break rules, applied in the configured order until a tie is resolved.
+const (
+	// TieBreakBackwards compares the tied candidates in the most recent
+	// earlier round where they differed.
+	TieBreakBackwards = "backwards"
+	// TieBreakForwards compares the tied candidates in the first round where
+	// they differed.
+	TieBreakForwards = "forwards"
+	// TieBreakFirstPreferences compares the number of ballots ranking each
+	// tied candidate first.
+	TieBreakFirstPreferences = "firstpreferences"
+	// TieBreakRandom draws a candidate using a seeded random number generator
+	// so the draw can be reproduced.
+	TieBreakRandom = "random"
+)
+
+// defaultTieBreakRules are used when no rules are configured.
+var defaultTieBreakRules = []string{TieBreakBackwards, TieBreakRandom}
+
+// TieBreak configures how ties are resolved when excluding or electing
+// candidates.
+type TieBreak struct {
+	Rules []string
+	// Seed seeds the random draw. If unset, it is derived from the ballots
+	// being counted so that recounts of the same ballots draw the same way.
+	Seed *int64
+}
+
+// RuleNames returns the configured rules or the default ones.
+func (t TieBreak) RuleNames() []string {
+	if len(t.Rules) == 0 {
+		return defaultTieBreakRules
+	}
+	return t.Rules
+}
+
+// Validate checks that every rule is known.
+func (t TieBreak) Validate() error {
+	for _, rule := range t.Rules {
+		switch rule {
+		case TieBreakBackwards, TieBreakForwards, TieBreakFirstPreferences, TieBreakRandom:
+		default:
+			return errors.Errorf("tiebreak: unknown rule %q", rule)
+		}
+	}
+	return nil
+}
+
+// tieBreaker resolves ties during a single count.
+type tieBreaker struct {
+	rules      []string
+	seed       int64
+	rng        *rand.Rand
+	firstPrefs map[string]float64
+}
+
+func newTieBreaker(cfg TieBreak, ballots [][]string) *tieBreaker {
+	t := &tieBreaker{
+		rules:      cfg.RuleNames(),
+		firstPrefs: map[string]float64{},
+	}
+	for _, ballot := range ballots {
+		t.firstPrefs[ballot[0]]++
+	}
+	if cfg.Seed != nil {
+		t.seed = *cfg.Seed
+	} else {
+		// Sort the ballots so the seed does not depend on the order they
+		// were added in.
+		lines := make([]string, len(ballots))
+		for i, ballot := range ballots {
+			lines[i] = fmt.Sprintf("%q\n", ballot)
+		}
+		sort.Strings(lines)
+		h := sha256.New()
+		for _, line := range lines {
+			h.Write([]byte(line))
+		}
+		t.seed = int64(binary.BigEndian.Uint64(h.Sum(nil)))
+	}
+	t.rng = rand.New(rand.NewSource(t.seed))
+	return t
+}
+
+// describe records the tie-break configuration on a result.
+func (t *tieBreaker) describe(res *Result) {
+	res.TieBreak = t.rules
+	for _, rule := range t.rules {
+		if rule == TieBreakRandom {
+			res.Seed = &t.seed
+		}
+	}
+}
+
+// extremeTied returns the candidates sharing the lowest, or if highest is
+// set, the highest tally.
+func extremeTied(candidates []string, tallies map[string]float64, highest bool) []string {
+	sign := 1.0
+	if highest {
+		sign = -1
+	}
+	var tied []string
+	for _, c := range candidates {
+		switch {
+		case len(tied) == 0 || sign*tallies[c] < sign*tallies[tied[0]]-tallyEpsilon:
+			tied = []string{c}
+		case math.Abs(tallies[c]-tallies[tied[0]]) <= tallyEpsilon:
+			tied = append(tied, c)
+		}
+	}
+	return tied
+}
+
+// pick chooses one of the tied candidates, the least preferred one if
+// highest is false, and returns it along with the rule that decided it.
+// Candidates that are still tied after every rule are resolved by picking
+// the one listed last, or first if highest is set. Unknown rules are an
+// error, so a misspelled rule can't silently decide a tie by order listed.
+func (t *tieBreaker) pick(tied []string, earlier []Round, highest bool) (string, string, error) {
+	remaining := tied
+	for _, rule := range t.rules {
+		switch rule {
+		case TieBreakBackwards:
+			for i := len(earlier) - 1; i >= 0 && len(remaining) > 1; i-- {
+				remaining = extremeTied(remaining, earlier[i].Tallies, highest)
+			}
+		case TieBreakForwards:
+			for i := 0; i < len(earlier) && len(remaining) > 1; i++ {
+				remaining = extremeTied(remaining, earlier[i].Tallies, highest)
+			}
+		case TieBreakFirstPreferences:
+			remaining = extremeTied(remaining, t.firstPrefs, highest)
+		case TieBreakRandom:
+			remaining = []string{remaining[t.rng.Intn(len(remaining))]}
+		default:
+			return "", "", errors.Errorf("tiebreak: unknown rule %q", rule)
+		}
+		if len(remaining) == 1 {
+			return remaining[0], rule, nil
+		}
+	}
+	if highest {
+		return remaining[0], "order listed", nil
+	}
+	return remaining[len(remaining)-1], "order listed", nil
+}
+
+// lowest picks the candidate to exclude from those in the round. The tied
+// candidates and deciding rule are returned if there was a tie.
+func (t *tieBreaker) lowest(candidates []string, round Round, earlier []Round) (string, []string, string, error) {
+	tied := extremeTied(candidates, round.Tallies, false)
+	if len(tied) == 1 {
+		return tied[0], nil, "", nil
+	}
+	excluded, rule, err := t.pick(tied, earlier, false)
+	if err != nil {
+		return "", nil, "", err
+	}
+	return excluded, tied, rule, nil
+}
+
+// topN elects the seats candidates with the highest tallies, breaking any tie
+// at the cut off. The tied candidates and deciding rule are returned if there
+// was a tie.
+func (t *tieBreaker) topN(candidates []string, tallies map[string]float64, seats int, earlier []Round) ([]string, []string, string, error) {
+	sorted := append([]string(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return tallies[sorted[i]] > tallies[sorted[j]]+tallyEpsilon
+	})
+	if seats >= len(sorted) {
+		return sorted, nil, "", nil
+	}
+	cut := tallies[sorted[seats-1]]
+	if math.Abs(tallies[sorted[seats]]-cut) > tallyEpsilon {
+		return sorted[:seats], nil, "", nil
+	}
+
+	var elected, tied []string
+	for _, c := range sorted {
+		switch {
+		case math.Abs(tallies[c]-cut) <= tallyEpsilon:
+			tied = append(tied, c)
+		case tallies[c] > cut:
+			elected = append(elected, c)
+		}
+	}
+	remaining := tied
+	var rules []string
+	for len(elected) < seats {
+		c, rule, err := t.pick(remaining, earlier, true)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		elected = append(elected, c)
+		remaining = remove(remaining, c)
+		rules = append(rules, rule)
+	}
+	return elected, tied, strings.Join(rules, ", "), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTieBreakRules(t *testing.T) {
+	earlier := []Round{
+		{Tallies: map[string]float64{"A": 1, "B": 2, "C": 5}},
+		{Tallies: map[string]float64{"A": 3, "B": 2, "C": 5}},
+	}
+	ballots := [][]string{{"A"}, {"A"}, {"B"}, {"C"}}
+
+	cases := []struct {
+		rules   []string
+		highest bool
+		want    string
+		rule    string
+	}{
+		{[]string{TieBreakBackwards}, false, "B", TieBreakBackwards},
+		{[]string{TieBreakForwards}, false, "A", TieBreakForwards},
+		{[]string{TieBreakBackwards}, true, "A", TieBreakBackwards},
+		{[]string{TieBreakFirstPreferences}, false, "B", TieBreakFirstPreferences},
+		{[]string{TieBreakFirstPreferences, TieBreakBackwards}, true, "A", TieBreakFirstPreferences},
+	}
+	for _, tc := range cases {
+		tb := newTieBreaker(TieBreak{Rules: tc.rules}, ballots)
+		got, rule, err := tb.pick([]string{"A", "B"}, earlier, tc.highest)
+		if err != nil || got != tc.want || rule != tc.rule {
+			t.Errorf("%+v highest=%v: got %q by %q, %v; wanted %q by %q", tc.rules, tc.highest, got, rule, err, tc.want, tc.rule)
+		}
+	}
+
+	// A misspelled rule isn't skipped in favour of the order listed.
+	poll, err := NewIRVPoll([]string{"A", "B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll.SetTieBreak(TieBreak{Rules: []string{"backward"}})
+	for _, ballot := range [][]string{{"A"}, {"B"}} {
+		if err := poll.AddBallot(ballot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := poll.Evaluate(); err == nil || !strings.Contains(err.Error(), `unknown rule "backward"`) {
+		t.Errorf("expected unknown rule to fail the count; got %v", err)
+	}
+}
+
+func TestTieBreakRandomReproducible(t *testing.T) {
+	count := func(seed *int64) *Result {
+		poll, err := NewIRVPoll([]string{"A", "B", "C", "D"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		poll.SetTieBreak(TieBreak{Rules: []string{TieBreakRandom}, Seed: seed})
+		for _, ballot := range [][]string{{"A"}, {"B"}, {"C"}, {"D"}} {
+			if err := poll.AddBallot(ballot); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := poll.Evaluate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	seed := int64(42)
+	a, b := count(&seed), count(&seed)
+	if !reflect.DeepEqual(a.Winners, b.Winners) {
+		t.Fatalf("same seed gave different winners %+v and %+v", a.Winners, b.Winners)
+	}
+	for _, round := range a.Rounds[:len(a.Rounds)-1] {
+		if round.TieBreak != TieBreakRandom {
+			t.Errorf("round not broken by random draw: %+v", round)
+		}
+	}
+
+	var buf bytes.Buffer
+	writeResult(&buf, a)
+	if !strings.Contains(buf.String(), "Tie-break: random (seed 42)") {
+		t.Errorf("report missing seed:\n%s", buf.String())
+	}
+
+	// Without a seed, it is derived from the ballots.
+	c, d := count(nil), count(nil)
+	if c.Seed == nil || *c.Seed != *d.Seed || !reflect.DeepEqual(c.Winners, d.Winners) {
+		t.Errorf("derived seed not reproducible")
+	}
+}
+
+func TestTieBreakTopN(t *testing.T) {
+	tallier, err := methods[MethodPlurality].New([]string{"A", "B", "C"}, TallyOptions{Seats: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tallier.SetTieBreak(TieBreak{Rules: []string{TieBreakFirstPreferences}})
+	for _, ballot := range [][]string{{"A"}, {"A"}, {"B"}, {"C"}} {
+		if err := tallier.AddBallot(ballot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := tallier.Evaluate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	round := res.Rounds[0]
+	if len(res.Winners) != 2 || res.Winners[0] != "A" || !reflect.DeepEqual(round.Tied, []string{"B", "C"}) {
+		t.Fatalf("got winners %+v tied %+v", res.Winners, round.Tied)
+	}
+}
+
+func TestTieBreakValidate(t *testing.T) {
+	if err := (TieBreak{Rules: []string{"coin"}}).Validate(); err == nil {
+		t.Error("expected error for unknown rule")
+	}
+}
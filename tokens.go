@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// VotingToken is a one-time token that lets a voter on the roll vote without
+// logging in, e.g. if they don't have a CS account. Only the token's hash is
+// stored.
+type VotingToken struct {
+	Hash string `gorm:"primary_key"`
+	// StudentNumber is the student number of the voter's roll entry, hashed
+	// if the roll is.
+	StudentNumber string `sql:"index"`
+	CreatedAt     time.Time
+	// UsedAt is when the token was used to vote, or nil if it hasn't been.
+	UsedAt *time.Time
+	// Address is the address the token's invitation was sent to, encrypted
+	// with the token so that only the voter can reveal it. It's where their
+	// confirmation is sent, since a hashed roll has no addresses.
+	Address []byte
+}
+
+// TableName implements gorm.tabler.
+func (VotingToken) TableName() string {
+	return "voting_tokens"
+}
+
+// TokenVoter is a voter voting with a token rather than logging in.
+type TokenVoter struct {
+	Hash  string
+	Entry *RollEntry
+	// Used is set if the token has already been used to vote.
+	Used bool
+	// Address is where the token's invitation was sent, if it was.
+	Address string
+}
+
+// errTokenUsed is returned for tokens that have already been used to vote.
+var errTokenUsed = errors.New("This voting token has already been used to vote.")
+
+// votingTokenKey is the request context key of the TokenVoter.
+type votingTokenKey struct{}
+
+// votingToken returns the voter voting with a token, or nil if they logged
+// in instead.
+func votingToken(r *http.Request) *TokenVoter {
+	voter, _ := r.Context().Value(votingTokenKey{}).(*TokenVoter)
+	return voter
+}
+
+// hashToken returns the stored hash of a token. Tokens are case insensitive.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(token))))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupToken returns the voter for an unused token.
+func lookupToken(db *gorm.DB, token string) (*TokenVoter, error) {
+	voter, err := findToken(db, token)
+	if err != nil {
+		return nil, err
+	}
+	if voter.Used {
+		return nil, errTokenUsed
+	}
+	return voter, nil
+}
+
+// findToken returns the voter for a token, whether or not it has been used.
+func findToken(db *gorm.DB, token string) (*TokenVoter, error) {
+	var record VotingToken
+	hash := hashToken(token)
+	if err := db.Where("hash = ?", hash).First(&record).Error; gorm.IsRecordNotFoundError(err) {
+		return nil, errors.New("Invalid voting token. Make sure you copied the whole link or token.")
+	} else if err != nil {
+		return nil, err
+	}
+	var entry RollEntry
+	if err := db.Where("student_number = ?", record.StudentNumber).First(&entry).Error; gorm.IsRecordNotFoundError(err) {
+		return nil, errors.New("The voter this token was issued to is no longer on the voter roll.")
+	} else if err != nil {
+		return nil, err
+	}
+	voter := &TokenVoter{Hash: hash, Entry: &entry, Used: record.UsedAt != nil}
+	if len(record.Address) > 0 {
+		address, err := unseal(tokenAddressKey(token), record.Address)
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypting voting token address")
+		}
+		voter.Address = string(address)
+	}
+	return voter, nil
+}
+
+// tokenAddressKey derives the key a token's invitation address is encrypted
+// with from the token.
+func tokenAddressKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(strings.ToUpper(strings.TrimSpace(token))))
+	mac.Write([]byte("address"))
+	return mac.Sum(nil)
+}
+
+// setTokenAddress records the address a token's invitation was sent to.
+func setTokenAddress(tx *gorm.DB, token, address string) error {
+	sealed, err := seal(tokenAddressKey(token), []byte(address))
+	if err != nil {
+		return err
+	}
+	return tx.Model(&VotingToken{}).Where("hash = ?", hashToken(token)).Update("address", sealed).Error
+}
+
+// consumeToken marks a token as used. It fails if the token has already
+// been used, so it must be called in the transaction that stores the ballot.
+func consumeToken(tx *gorm.DB, hash string, at time.Time) error {
+	res := tx.Model(&VotingToken{}).Where("hash = ? AND used_at IS NULL", hash).Update("used_at", at)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return errTokenUsed
+	}
+	return nil
+}
+
+// tokenOrLogin wraps a handler for a page that voters can use either logged
+// in or with the voting token in the token form field. The token's voter can
+// be read with votingToken. A used token is only let through to resubmit a
+// ballot form, so submitVote can return the first receipt.
+func (s *server) tokenOrLogin(h http.HandlerFunc) http.HandlerFunc {
+	login := s.login(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		if token == "" {
+			login(w, r)
+			return
+		}
+		voter, err := findToken(s.db, token)
+		if err == nil && voter.Used && (r.Method != http.MethodPost || r.FormValue(idempotencyField) == "") {
+			err = errTokenUsed
+		}
+		if err != nil {
+			notLoggedIn(w, r, err)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), votingTokenKey{}, voter)))
+	}
+}
+
+// voterIdentity returns the voter roll entry, which is nil if there's no
+// roll, and the stored username of the voter making a request with the
+// student number they entered.
+func voterIdentity(db *gorm.DB, r *http.Request, sid string) (*RollEntry, string, error) {
+	if token := votingToken(r); token != nil {
+		sidKey, err := voterKey(keyStudentNumber, sid)
+		if err != nil {
+			return nil, "", err
+		}
+		if sidKey != token.Entry.StudentNumber {
+			return nil, "", errors.New("Student number doesn't match the voter your voting token was issued to. Make sure you typed it in correctly.")
+		}
+		return token.Entry, token.Entry.Username, nil
+	}
+
+	user := remoteUser(r)
+	if len(user) == 0 {
+		return nil, "", errors.New("missing REMOTE_USER")
+	}
+	entry, err := lookupRoll(db, sid, user)
+	if err != nil {
+		return nil, "", err
+	}
+	userKey, err := voterKey(keyUsername, user)
+	if err != nil {
+		return nil, "", err
+	}
+	return entry, userKey, nil
+}
+
+// issueTokens creates a voting token for each of the student numbers, as
+// stored on the roll, that hasn't voted. Voters who already have an unused
+// token are skipped unless replace is set, in which case it's replaced. It
+// returns the new tokens by student number.
+func issueTokens(db *gorm.DB, sidKeys []string, replace bool) (map[string]string, error) {
+	tx := db.Begin()
+	defer tx.Rollback()
+	tokens, err := createTokens(tx, sidKeys, replace)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// createTokens issues tokens like issueTokens in an existing transaction.
+func createTokens(tx *gorm.DB, sidKeys []string, replace bool) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, sidKey := range sidKeys {
+		voted := 0
+		if err := tx.Model(&Voter{}).Where("student_number = ?", sidKey).Count(&voted).Error; err != nil {
+			return nil, err
+		}
+		if voted > 0 {
+			continue
+		}
+		unused := tx.Where("student_number = ? AND used_at IS NULL", sidKey)
+		if replace {
+			if err := unused.Delete(&VotingToken{}).Error; err != nil {
+				return nil, err
+			}
+		} else {
+			count := 0
+			if err := unused.Model(&VotingToken{}).Count(&count).Error; err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				continue
+			}
+		}
+
+		token, err := newTracker()
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&VotingToken{Hash: hashToken(token), StudentNumber: sidKey}).Error; err != nil {
+			return nil, err
+		}
+		tokens[sidKey] = token
+	}
+	return tokens, nil
+}
+
+// writeTokensCSV writes the voters who were issued tokens, with links to
+// vote, for distributing the tokens.
+func writeTokensCSV(w io.Writer, entries []RollEntry, sidKeys []string, tokens map[string]string, baseURL string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"student_number", "username", "name", "token", "url"}); err != nil {
+		return err
+	}
+	for i, e := range entries {
+		token, ok := tokens[sidKeys[i]]
+		if !ok {
+			continue
+		}
+		link := ""
+		if baseURL != "" {
+			link = strings.TrimSuffix(baseURL, "/") + "/?token=" + token
+		}
+		if err := cw.Write([]string{e.StudentNumber, e.Username, e.Name, token, link}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// loadUnhashedRoll returns the voter roll with voters' details, along with
+// each entry's student number as stored on the roll. If the roll is hashed,
+// the details are read from the unhashed roll file at path, which must match
+// the imported roll; otherwise path may be empty to use the imported roll.
+func loadUnhashedRoll(db *gorm.DB, path string) ([]RollEntry, []string, error) {
+	var entries []RollEntry
+	var sidKeys []string
+	if path != "" {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entries, err = parseRoll(path, bytes.NewReader(body)); err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			sidKey, err := voterKey(keyStudentNumber, e.StudentNumber)
+			if err != nil {
+				return nil, nil, err
+			}
+			count := 0
+			if err := db.Model(&RollEntry{}).Where("student_number = ?", sidKey).Count(&count).Error; err != nil {
+				return nil, nil, err
+			}
+			if count == 0 {
+				return nil, nil, errors.Errorf("student number %q isn't on the imported voter roll", e.StudentNumber)
+			}
+			sidKeys = append(sidKeys, sidKey)
+		}
+	} else {
+		if hashedRoll() {
+			return nil, nil, errors.New("the voter roll is hashed; pass the unhashed roll file to match voters' details")
+		}
+		if err := db.Order("student_number").Find(&entries).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			sidKeys = append(sidKeys, e.StudentNumber)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil, errors.New("the voter roll is empty; import one with import-roll first")
+	}
+	return entries, sidKeys, nil
+}
+
+// runIssueTokens implements the issue-tokens command.
+func runIssueTokens(args []string) error {
+	fs := flag.NewFlagSet("issue-tokens", flag.ExitOnError)
+	out := fs.String("o", "", "write the tokens to this file instead of stdout")
+	replace := fs.Bool("replace", false, "replace voters' unused tokens instead of skipping them")
+	baseURL := fs.String("url", "", "the URL of elections.cgi, to include a link to vote with each token")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: elections issue-tokens [-replace] [-url https://.../elections.cgi] [-o tokens.csv] [roll.csv|roll.json]\n\n"+
+			"Issues one-time voting tokens to voters on the roll who haven't voted and writes\n"+
+			"them as CSV. If the roll is hashed, pass the unhashed roll file it was made from\n"+
+			"so the tokens can be matched to voters.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one roll file")
+	}
+
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	db, err := gorm.Open("sqlite3", c.DBPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to database")
+	}
+	defer db.Close()
+	if err := runMigrate(db); err != nil {
+		return err
+	}
+
+	entries, sidKeys, err := loadUnhashedRoll(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Open the output first, since the tokens can't be recovered if they
+	// can't be written.
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	tokens, err := issueTokens(db, sidKeys, *replace)
+	if err != nil {
+		return err
+	}
+	audit(AuditTokensIssued, map[string]string{"tokens": strconv.Itoa(len(tokens))})
+
+	if err := writeTokensCSV(w, entries, sidKeys, tokens, *baseURL); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Issued %d tokens.\n", len(tokens))
+	return nil
+}
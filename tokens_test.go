@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVotingTokens(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := importRoll(s.db, []RollEntry{
+		{StudentNumber: "12345678", Username: "test", Name: "Test Voter"},
+		{StudentNumber: "23456789", Username: "other"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sids := []string{"12345678", "23456789"}
+	tokens, err := issueTokens(s.db, sids, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[sids[0]] == tokens[sids[1]] {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+	if again, err := issueTokens(s.db, sids, false); err != nil || len(again) != 0 {
+		t.Fatalf("expected voters with tokens to be skipped; got %v, %v", again, err)
+	}
+
+	var csv bytes.Buffer
+	entries := []RollEntry{{StudentNumber: "12345678", Username: "test", Name: "Test Voter"}}
+	if err := writeTokensCSV(&csv, entries, sids[:1], tokens, "https://example.com/elections.cgi"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "12345678,test,Test Voter," + tokens[sids[0]] + ",https://example.com/elections.cgi/?token=" + tokens[sids[0]]; !strings.Contains(csv.String(), want) {
+		t.Errorf("tokens CSV missing %q:\n%s", want, csv.String())
+	}
+
+	// Voters with tokens don't log in.
+	os.Setenv("REMOTE_USER", "")
+	defer os.Setenv("REMOTE_USER", "test")
+	token := tokens[sids[0]]
+
+	get := func(target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, httptest.NewRequest("GET", target, nil))
+		return resp
+	}
+	if resp := get("/?token=bogus"); resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "Invalid voting token") {
+		t.Errorf("expected invalid token to be rejected; got %d", resp.Code)
+	}
+	resp := get("/?token=" + strings.ToLower(token))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	for _, want := range []string{"Welcome, Test Voter!", `<input type="hidden" name="token" value="` + strings.ToLower(token) + `">`} {
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Errorf("ballot missing %q", want)
+		}
+	}
+
+	vote := func(token, sid, key string) *httptest.ResponseRecorder {
+		form := goodForm()
+		form.Set("student_number", sid)
+		form.Set("token", token)
+		form.Set(idempotencyField, key)
+		req := httptest.NewRequest("POST", "/vote", nil)
+		req.Form = form
+		addCSRF(t, req)
+		resp := httptest.NewRecorder()
+		s.mux.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := vote(tokens[sids[1]], sids[0], ""); resp.Code != http.StatusInternalServerError || !strings.Contains(html.UnescapeString(resp.Body.String()), "doesn't match the voter your voting token was issued to") {
+		t.Errorf("expected another voter's token to be rejected; got %d", resp.Code)
+	}
+	const key = "0123456789abcdef0123456789abcdef"
+	first := vote(token, sids[0], key)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", first.Body.Bytes())
+	}
+
+	var voter Voter
+	if err := s.db.Where("student_number = ?", sids[0]).First(&voter).Error; err != nil {
+		t.Fatal(err)
+	}
+	if voter.Username != "test" {
+		t.Errorf("expected vote to be recorded for the token's voter; got %+v", voter)
+	}
+	var record VotingToken
+	if err := s.db.Where("hash = ?", hashToken(token)).First(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	if record.UsedAt == nil {
+		t.Errorf("expected token to be used")
+	}
+
+	// Resubmitting the same form returns the first receipt, but the used
+	// token can't do anything else.
+	if second := vote(token, sids[0], key); second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("expected resubmission to return the first receipt; got %s", second.Body.Bytes())
+	}
+	count := 0
+	if err := s.db.Model(&BallotRecord{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 ballot; got %d", count)
+	}
+	for _, key := range []string{"", "fedcba9876543210fedcba9876543210"} {
+		if resp := vote(token, sids[0], key); !strings.Contains(resp.Body.String(), "already been used") {
+			t.Errorf("expected used token to be rejected with key %q; got %s", key, resp.Body.Bytes())
+		}
+	}
+	if resp := get("/?token=" + token); !strings.Contains(resp.Body.String(), "already been used") {
+		t.Errorf("expected used token to be rejected; got %s", resp.Body.Bytes())
+	}
+	if err := consumeToken(s.db, hashToken(token), time.Now()); err == nil {
+		t.Errorf("expected token to only be consumed once")
+	}
+
+	if again, err := issueTokens(s.db, sids, true); err != nil || len(again) != 1 || again[sids[0]] != "" {
+		t.Errorf("expected only the voter who hasn't voted to get a new token; got %v, %v", again, err)
+	}
+	if _, err := lookupToken(s.db, tokens[sids[1]]); err == nil {
+		t.Errorf("expected replaced token to be invalid")
+	}
+
+	// Another voter can't load the receipt with the same key.
+	again, err := issueTokens(s.db, sids[1:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := vote(again[sids[1]], sids[1], key); resp.Code != http.StatusOK || resp.Body.String() == first.Body.String() {
+		t.Errorf("expected another voter's submission to be accepted; got %s", resp.Body.Bytes())
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// turnoutChartHeight is the height of the turnout charts, in SVG user units.
+// They are chartWidth wide.
+const turnoutChartHeight = 160
+
+// turnoutRefresh is how often, in seconds, the turnout dashboard reloads.
+const turnoutRefresh = 60
+
+// TurnoutBucket is the number of votes cast in an hour or a day.
+type TurnoutBucket struct {
+	Start time.Time
+	Label string
+	// Tick labels the axis at the start of the bucket, if set.
+	Tick       string
+	Votes      int
+	Cumulative int
+	X          float64
+	Y          float64
+	Width      float64
+	Height     float64
+}
+
+// TurnoutChart is a column chart of the votes cast over time.
+type TurnoutChart struct {
+	Buckets []TurnoutBucket
+	// Max is the most votes in a bucket.
+	Max int
+}
+
+// TurnoutGroup is the turnout of the voters on the roll sharing a year,
+// program or class.
+type TurnoutGroup struct {
+	Name string
+	Turnout
+	Y     float64
+	Width float64
+}
+
+// TurnoutBreakdown is the turnout by one attribute of the voter roll.
+type TurnoutBreakdown struct {
+	Attribute string
+	Groups    []TurnoutGroup
+	Height    float64
+}
+
+// TurnoutDashboard is the data for turnout.html. It's built from when each
+// voter voted and their voter roll entry, and never looks at ballots.
+type TurnoutDashboard struct {
+	Turnout Turnout
+	Updated time.Time
+	Refresh int
+	Hours   TurnoutChart
+	Days    TurnoutChart
+	// Cumulative is the SVG polyline of the running total of votes over the
+	// hours, scaled to the size of the roll if known. CumulativeMax is the
+	// number of votes at the top of the chart.
+	Cumulative    string
+	CumulativeMax int
+	Breakdowns    []TurnoutBreakdown
+	// Unlisted is the number of voters who aren't on the voter roll, e.g.
+	// because it was replaced after they voted.
+	Unlisted int
+}
+
+// newTurnoutChart counts the votes cast at times, which must be sorted, in
+// buckets from start until end. next returns the start of the following
+// bucket.
+func newTurnoutChart(times []time.Time, start, end time.Time, next func(time.Time) time.Time, label, tick func(time.Time) string) TurnoutChart {
+	var chart TurnoutChart
+	i := 0
+	cumulative := 0
+	for t := start; t.Before(end); t = next(t) {
+		bucket := TurnoutBucket{Start: t, Label: label(t), Tick: tick(t)}
+		for ; i < len(times) && times[i].Before(next(t)); i++ {
+			bucket.Votes++
+		}
+		cumulative += bucket.Votes
+		bucket.Cumulative = cumulative
+		if bucket.Votes > chart.Max {
+			chart.Max = bucket.Votes
+		}
+		chart.Buckets = append(chart.Buckets, bucket)
+	}
+
+	if len(chart.Buckets) == 0 {
+		return chart
+	}
+	width := float64(chartWidth) / float64(len(chart.Buckets))
+	for i := range chart.Buckets {
+		b := &chart.Buckets[i]
+		b.X = float64(i) * width
+		b.Width = width
+		if chart.Max > 0 {
+			b.Height = turnoutChartHeight * float64(b.Votes) / float64(chart.Max)
+		}
+		b.Y = turnoutChartHeight - b.Height
+	}
+	return chart
+}
+
+// cumulativeLine returns the SVG polyline points of the running total of
+// votes at the end of each bucket, with max votes at the top of the chart.
+func cumulativeLine(chart TurnoutChart, max int) string {
+	if max == 0 || len(chart.Buckets) == 0 {
+		return ""
+	}
+	points := []string{fmt.Sprintf("0,%d", turnoutChartHeight)}
+	for _, b := range chart.Buckets {
+		y := turnoutChartHeight * (1 - float64(b.Cumulative)/float64(max))
+		points = append(points, svgNum(b.X+b.Width)+","+svgNum(y))
+	}
+	return strings.Join(points, " ")
+}
+
+// newTurnoutBreakdown lays out the turnout of the groups of roll entries with
+// the same attribute, as returned by key. It returns false if no entry has
+// the attribute.
+func newTurnoutBreakdown(attribute string, roll []RollEntry, voted map[string]bool, key func(RollEntry) string) (TurnoutBreakdown, bool) {
+	breakdown := TurnoutBreakdown{Attribute: attribute}
+	groups := map[string]*TurnoutGroup{}
+	var names []string
+	known := false
+	for _, entry := range roll {
+		name := key(entry)
+		if name != "" {
+			known = true
+		} else {
+			name = "Unknown"
+		}
+		g, ok := groups[name]
+		if !ok {
+			g = &TurnoutGroup{Name: name}
+			groups[name] = g
+			names = append(names, name)
+		}
+		g.Eligible++
+		if voted[entry.StudentNumber] {
+			g.Ballots++
+		}
+	}
+	if !known {
+		return breakdown, false
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if (a == "Unknown") != (b == "Unknown") {
+			return b == "Unknown"
+		}
+		// Sort years numerically.
+		if x, err := strconv.Atoi(a); err == nil {
+			if y, err := strconv.Atoi(b); err == nil {
+				return x < y
+			}
+		}
+		return a < b
+	})
+	for _, name := range names {
+		g := *groups[name]
+		g.Y = float64(len(breakdown.Groups) * chartBarHeight)
+		g.Width = g.Percent() / 100 * (chartWidth - chartLabelWidth - chartValueWidth)
+		breakdown.Groups = append(breakdown.Groups, g)
+	}
+	breakdown.Height = float64(len(breakdown.Groups) * chartBarHeight)
+	return breakdown, true
+}
+
+// newTurnoutDashboard builds the turnout dashboard from the voters table and
+// the voter roll. While polls are open, the charts run until now.
+func newTurnoutDashboard(db *gorm.DB) (*TurnoutDashboard, error) {
+	loc, err := c.location()
+	if err != nil {
+		return nil, err
+	}
+	// Only when and which student voted are needed; names are never loaded.
+	var voters []Voter
+	if err := db.Select("student_number, created_at").Order("created_at").Find(&voters).Error; err != nil {
+		return nil, err
+	}
+	eligible, err := rollSize(db)
+	if err != nil {
+		return nil, err
+	}
+	var roll []RollEntry
+	if err := db.Find(&roll).Error; err != nil {
+		return nil, err
+	}
+
+	current := now().In(loc)
+	dashboard := &TurnoutDashboard{
+		Turnout: Turnout{Ballots: len(voters), Eligible: eligible},
+		Updated: current,
+		Refresh: turnoutRefresh,
+	}
+
+	voted := map[string]bool{}
+	var times []time.Time
+	for _, v := range voters {
+		voted[v.StudentNumber] = true
+		times = append(times, v.CreatedAt.In(loc))
+	}
+	onRoll := map[string]bool{}
+	for _, entry := range roll {
+		onRoll[entry.StudentNumber] = true
+	}
+	if len(roll) > 0 {
+		for sid := range voted {
+			if !onRoll[sid] {
+				dashboard.Unlisted++
+			}
+		}
+	}
+
+	if len(times) > 0 {
+		first, last := times[0], times[len(times)-1]
+		end := last
+		if pollsOpen() && current.After(end) {
+			end = current
+		}
+		hour := time.Date(first.Year(), first.Month(), first.Day(), first.Hour(), 0, 0, 0, loc)
+		day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc)
+		dashboard.Hours = newTurnoutChart(times, hour, end.Add(time.Nanosecond),
+			func(t time.Time) time.Time { return t.Add(time.Hour) },
+			func(t time.Time) string { return t.Format("Mon Jan 2, 3 PM") },
+			func(t time.Time) string {
+				if t.Hour() == 0 {
+					return t.Format("Jan 2")
+				}
+				return ""
+			},
+		)
+		dashboard.Days = newTurnoutChart(times, day, end.Add(time.Nanosecond),
+			func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+			func(t time.Time) string { return t.Format("Mon Jan 2") },
+			func(t time.Time) string { return t.Format("Jan 2") },
+		)
+		dashboard.CumulativeMax = eligible
+		if dashboard.CumulativeMax < len(times) {
+			dashboard.CumulativeMax = len(times)
+		}
+		dashboard.Cumulative = cumulativeLine(dashboard.Hours, dashboard.CumulativeMax)
+	}
+
+	for _, attribute := range []struct {
+		name string
+		key  func(RollEntry) string
+	}{
+		{"Year", func(e RollEntry) string {
+			if e.Year == 0 {
+				return ""
+			}
+			return strconv.Itoa(e.Year)
+		}},
+		{"Program", func(e RollEntry) string { return e.Program }},
+		{"Class", func(e RollEntry) string { return e.Class }},
+	} {
+		if breakdown, ok := newTurnoutBreakdown(attribute.name, roll, voted, attribute.key); ok {
+			dashboard.Breakdowns = append(dashboard.Breakdowns, breakdown)
+		}
+	}
+	return dashboard, nil
+}
+
+// handleTurnout shows the turnout dashboard. It reloads itself every
+// turnoutRefresh seconds, so unlike the results it isn't audited.
+func (s *server) handleTurnout(w *TemplateWriter, r *http.Request) error {
+	w.Title("Turnout")
+
+	if _, err := adminUser(r); err != nil {
+		return err
+	}
+	dashboard, err := newTurnoutDashboard(s.db)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Refresh", strconv.Itoa(turnoutRefresh))
+	return s.tmpl.ExecuteTemplate(w, "turnout.html", dashboard)
+}
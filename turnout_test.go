@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTurnoutChart(t *testing.T) {
+	start := time.Date(2020, 3, 1, 22, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		start.Add(10 * time.Minute),
+		start.Add(20 * time.Minute),
+		start.Add(2*time.Hour + 5*time.Minute),
+	}
+	chart := newTurnoutChart(times, start, times[2].Add(time.Nanosecond),
+		func(t time.Time) time.Time { return t.Add(time.Hour) },
+		func(t time.Time) string { return t.Format("15:04") },
+		func(t time.Time) string {
+			if t.Hour() == 0 {
+				return "midnight"
+			}
+			return ""
+		},
+	)
+	if len(chart.Buckets) != 3 || chart.Max != 2 {
+		t.Fatalf("unexpected chart: %+v", chart)
+	}
+	var votes, cumulative []int
+	for _, b := range chart.Buckets {
+		votes = append(votes, b.Votes)
+		cumulative = append(cumulative, b.Cumulative)
+	}
+	if votes[0] != 2 || votes[1] != 0 || votes[2] != 1 || cumulative[2] != 3 {
+		t.Errorf("got votes %v and running total %v", votes, cumulative)
+	}
+	if b := chart.Buckets[0]; b.Height != turnoutChartHeight || b.Y != 0 || b.Width*3 != chartWidth {
+		t.Errorf("unexpected first bar: %+v", b)
+	}
+	if chart.Buckets[2].Tick != "midnight" || chart.Buckets[1].Tick != "" {
+		t.Errorf("unexpected ticks: %+v", chart.Buckets)
+	}
+	if got, want := cumulativeLine(chart, 6), "0,160 213.33,106.67 426.67,106.67 640,80"; got != want {
+		t.Errorf("cumulativeLine = %q; wanted %q", got, want)
+	}
+}
+
+func TestTurnoutDashboard(t *testing.T) {
+	s, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := importRoll(s.db, []RollEntry{
+		{StudentNumber: "12345678", Username: "test", Program: "BCS", Year: 2},
+		{StudentNumber: "23456789", Username: "other", Program: "BSc", Year: 10},
+		{StudentNumber: "34567890", Username: "third", Program: "BSc"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	castVote(t, s, goodForm())
+
+	dashboard, err := newTurnoutDashboard(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dashboard.Turnout != (Turnout{Ballots: 1, Eligible: 3}) || dashboard.Unlisted != 0 {
+		t.Errorf("unexpected turnout: %+v", dashboard)
+	}
+	if len(dashboard.Hours.Buckets) == 0 || dashboard.Hours.Max != 1 || len(dashboard.Days.Buckets) != 1 {
+		t.Errorf("unexpected charts: %+v %+v", dashboard.Hours, dashboard.Days)
+	}
+	if len(dashboard.Breakdowns) != 2 {
+		t.Fatalf("expected year and program breakdowns; got %+v", dashboard.Breakdowns)
+	}
+	var years []string
+	for _, g := range dashboard.Breakdowns[0].Groups {
+		years = append(years, g.Name)
+	}
+	if strings.Join(years, ",") != "2,10,Unknown" {
+		t.Errorf("got years %v", years)
+	}
+	if g := dashboard.Breakdowns[1].Groups[0]; g.Name != "BCS" || g.Turnout != (Turnout{Ballots: 1, Eligible: 1}) {
+		t.Errorf("unexpected BCS turnout: %+v", g)
+	}
+
+	c.Admins = []string{"test"}
+	req := httptest.NewRequest("GET", "/admin/turnout", nil)
+	resp := httptest.NewRecorder()
+	s.mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected StatusOK; got %s", resp.Body.Bytes())
+	}
+	if resp.Header().Get("Refresh") == "" {
+		t.Errorf("expected the dashboard to refresh")
+	}
+	body := resp.Body.String()
+	for _, want := range []string{
+		"1 people have voted out of\n3 eligible voters, a turnout of\n33.3%",
+		"<h2>Turnout by Program</h2>",
+		"0/2 (0.0%)",
+		"<polyline",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("turnout page missing %q:\n%s", want, body)
+		}
+	}
+	for _, choice := range []string{"Candidate", "Voter"} {
+		if strings.Contains(body, choice) {
+			t.Errorf("turnout page contains %q", choice)
+		}
+	}
+}